@@ -0,0 +1,350 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/visitor"
+)
+
+const buildUsage = `Usage: kaleido build [options] file.kal
+
+Compile a whole program ahead of time, into a native object file by default.
+Without any of -emit-llvm, -emit-bc and -shared, the format is inferred from
+the extension of the output given with -o: .o, .ll, .bc or .so. Any other
+output is an executable printing the value of each top level expression. The
+runtime library is linked in, with the C compiler given by the CC environment
+variable, cc by default. With -shared, the program is linked into a shared
+library exporting the functions of the program, except the private ones,
+which -emit-header declares for C. An output extension conflicting with the
+options is rejected.
+
+Options:
+`
+
+// runBuild implements the build subcommand, and returns the exit code.
+func runBuild(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), buildUsage)
+		flags.PrintDefaults()
+	}
+	emitLLVMPtr := flags.Bool("emit-llvm", false, "Write the program as textual LLVM IR (.ll)")
+	emitBitcodePtr := flags.Bool("emit-bc", false, "Write the program as LLVM bitcode (.bc)")
+	sharedPtr := flags.Bool("shared", false, "Link the program into a shared library (.so)")
+	headerPtr := flags.String("emit-header", EMPTY_STRING, "C header file where the exported functions are declared")
+	outputPtr := flags.String("o", EMPTY_STRING, "Output file, named after the source file by default")
+	compiler := registerCompilerFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	exclusive := 0
+	for _, set := range []bool{*emitLLVMPtr, *emitBitcodePtr, *sharedPtr} {
+		if set {
+			exclusive++
+		}
+	}
+	if exclusive > 1 {
+		fmt.Fprintln(os.Stderr, "Only one of -emit-llvm, -emit-bc and -shared can be given")
+		return 2
+	}
+	done, err := compiler.apply()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer done()
+
+	format, option := objectFormat, EMPTY_STRING
+	switch {
+	case *emitLLVMPtr:
+		format, option = llvmIRFormat, "-emit-llvm"
+	case *emitBitcodePtr:
+		format, option = bitcodeFormat, "-emit-bc"
+	case *sharedPtr:
+		format, option = sharedFormat, "-shared"
+	}
+	if *outputPtr != EMPTY_STRING {
+		inferred, known := formatsByExtension[filepath.Ext(*outputPtr)]
+		switch {
+		case option == EMPTY_STRING && known:
+			format = inferred
+		case option == EMPTY_STRING:
+			format = executableFormat
+		case known && inferred.extension != format.extension:
+			fmt.Fprintf(os.Stderr, "The output %s conflicts with %s, which writes a %s file\n", *outputPtr, option, format.extension)
+			return 2
+		}
+	}
+	output := *outputPtr
+	if output == EMPTY_STRING {
+		source := flags.Arg(0)
+		output = strings.TrimSuffix(filepath.Base(source), filepath.Ext(source)) + format.extension
+		if format.shared {
+			output = "lib" + output
+		}
+	}
+	if err := buildProgram(flags.Arg(0), output, format, *headerPtr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+type outputFormat struct {
+	extension string
+	write     func(module llvm.Module, file *os.File) error
+	// linked formats are linked by the C compiler instead of written, into
+	// an executable with a generated main function unless shared.
+	linked bool
+	shared bool
+}
+
+var (
+	objectFormat = outputFormat{extension: ".o", write: func(module llvm.Module, file *os.File) error {
+		object, err := visitor.EmitObject(module)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(object)
+		return err
+	}}
+	llvmIRFormat = outputFormat{extension: ".ll", write: func(module llvm.Module, file *os.File) error {
+		_, err := file.WriteString(module.String())
+		return err
+	}}
+	bitcodeFormat = outputFormat{extension: ".bc", write: func(module llvm.Module, file *os.File) error {
+		return llvm.WriteBitcodeToFile(module, file)
+	}}
+	executableFormat = outputFormat{extension: "", linked: true}
+	sharedFormat     = outputFormat{extension: ".so", linked: true, shared: true}
+)
+
+// formatsByExtension are the formats inferred from the extension of the
+// output file.
+var formatsByExtension = map[string]outputFormat{
+	objectFormat.extension:  objectFormat,
+	llvmIRFormat.extension:  llvmIRFormat,
+	bitcodeFormat.extension: bitcodeFormat,
+	sharedFormat.extension:  sharedFormat,
+}
+
+// buildProgram compiles a source file, and the bitcode libraries, into a
+// single module written to the output file, or linked into an executable or
+// a shared library. The exported functions are declared in the header file,
+// if given.
+func buildProgram(source string, output string, format outputFormat, header string) error {
+	kaleidoAST, err := newLoader().LoadFile(source)
+	if err != nil {
+		return err
+	}
+	aotVisitor, err := visitor.NewVisitorKaleidoAOT()
+	if err != nil {
+		return err
+	}
+	kaleidoVisitor, err := configureVisitor(aotVisitor)
+	if err != nil {
+		return err
+	}
+	defer kaleidoVisitor.Close()
+	err = kaleidoVisitor.FeedAST(kaleidoAST)
+	for _, warning := range kaleidoVisitor.FlushWarnings() {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
+	}
+	if err != nil {
+		return err
+	}
+	if format.linked && !format.shared {
+		if err := kaleidoVisitor.DefineExecutableMain(); err != nil {
+			return err
+		}
+	}
+	module, err := kaleidoVisitor.Module()
+	if err != nil {
+		return err
+	}
+	var exports []string
+	if format.shared || header != EMPTY_STRING {
+		if exports, err = exportedNames(&kaleidoVisitor); err != nil {
+			return err
+		}
+	}
+	if err := writeOutput(module, output, format, kaleidoVisitor.Libraries(), exports); err != nil {
+		return err
+	}
+	// The header is only written once the program is built.
+	if header != EMPTY_STRING {
+		return writeHeader(&kaleidoVisitor, header, source)
+	}
+	return nil
+}
+
+// exportedNames returns the names of the functions exported by the program,
+// rejecting the names which are not usable from C.
+func exportedNames(kaleidoVisitor *visitor.VisitorKaleido) ([]string, error) {
+	functions, err := kaleidoVisitor.ExportedFunctions()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(functions))
+	for _, function := range functions {
+		if visitor.IsReservedCName(function.Name) {
+			return nil, fmt.Errorf("Function %s cannot be exported, it is named like a C keyword or a function of the C library", function.Name)
+		}
+		names = append(names, function.Name)
+	}
+	return names, nil
+}
+
+// writeOutput writes a module to the output file, or links it.
+func writeOutput(module llvm.Module, output string, format outputFormat, libraries []string, exports []string) error {
+	if format.linked {
+		return linkProgram(module, output, libraries, format.shared, exports)
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := format.write(module, file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+const headerTemplate = `// Generated by kaleido build from %s.
+
+#ifndef %s
+#define %s
+
+#include <stdbool.h>
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+%s
+#ifdef __cplusplus
+}
+#endif
+
+#endif
+`
+
+// writeHeader writes the C declarations of the functions exported by the
+// program.
+func writeHeader(kaleidoVisitor *visitor.VisitorKaleido, header string, source string) error {
+	functions, err := kaleidoVisitor.ExportedFunctions()
+	if err != nil {
+		return err
+	}
+	var declarations strings.Builder
+	for _, function := range functions {
+		declarations.WriteString(visitor.CDeclaration(function) + "\n")
+	}
+	guard := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, filepath.Base(header))
+	content := fmt.Sprintf(headerTemplate, filepath.Base(source), guard, guard, declarations.String())
+	return ioutil.WriteFile(header, []byte(content), 0644)
+}
+
+// linkProgram links the object code of a module with the runtime library and
+// the shared libraries loaded by the program, into an executable or a shared
+// library, using the C compiler as the driver of the system linker. A shared
+// library only exports the given functions, through a version script: the
+// functions of the runtime library stay local.
+func linkProgram(module llvm.Module, output string, libraries []string, shared bool, exports []string) error {
+	linker := toolFromEnv("CC", "cc")
+	if _, err := exec.LookPath(linker); err != nil {
+		return fmt.Errorf("No C compiler to link the executable, set CC: %w", err)
+	}
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	object, err := visitor.EmitObject(module)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "kaleido-build")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "program.o"), object, 0644); err != nil {
+		return err
+	}
+	if err := buildRuntimeLibrary(filepath.Join(dir, "libkaleidort.a")); err != nil {
+		return err
+	}
+	args := []string{"-o", output, "program.o", "libkaleidort.a"}
+	if shared {
+		script := "{\n  global:\n"
+		for _, name := range exports {
+			script += "    " + name + ";\n"
+		}
+		script += "  local:\n    *;\n};\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, "exports.map"), []byte(script), 0644); err != nil {
+			return err
+		}
+		args = append([]string{"-shared", "-Wl,--version-script=exports.map"}, args...)
+	}
+	for _, library := range libraries {
+		args = append(args, libraryLinkArg(library))
+	}
+	args = append(args, "-lm")
+	return runTool(dir, linker, args...)
+}
+
+// libraryLinkArg returns the linker argument for a shared library loaded
+// with dlopen: a path is given as is, and a name such as libcrypt.so.1 is
+// searched in the directories of the linker.
+func libraryLinkArg(library string) string {
+	if strings.ContainsRune(library, filepath.Separator) {
+		if path, err := filepath.Abs(library); err == nil {
+			return path
+		}
+		return library
+	}
+	return "-l:" + library
+}
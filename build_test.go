@@ -0,0 +1,157 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// requireCompiler skips the test when no C compiler can link the programs.
+func requireCompiler(t *testing.T) {
+	if _, err := exec.LookPath(toolFromEnv("CC", "cc")); err != nil {
+		t.Skip("No C compiler to link the programs")
+	}
+}
+
+func TestBuildExecutables(t *testing.T) {
+	requireCompiler(t)
+	// The output of each sample, except the ones replacing a definition,
+	// which cannot be executables.
+	outputs := map[string]string{
+		"cextern.kal":          "12345 has 5 digits\n22.000000\n",
+		"expr_simple_call.kal": "85.000000\n",
+		"expr_simple_op.kal":   "9.000000\n",
+		"expr_single.kal":      "42.000000\n",
+		"extern.kal":           "0.330465\n",
+		"func_decl.kal":        "",
+		"runtime.kal":          "",
+		"types.kal":            "3.000000\n",
+	}
+	failing := map[string]bool{"globals.kal": true, "multiple_top_expr.kal": true}
+	samples, err := filepath.Glob("samples/valid/*.kal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, sample := range samples {
+		name := filepath.Base(sample)
+		executable := filepath.Join(dir, name+".out")
+		status := runBuild([]string{"-o", executable, sample})
+		if failing[name] {
+			if status == 0 {
+				t.Errorf("%s replaces a definition, it should not be built into an executable", name)
+			}
+			continue
+		}
+		expected, found := outputs[name]
+		if !found {
+			t.Errorf("No expected output for %s", name)
+			continue
+		}
+		if status != 0 {
+			t.Errorf("Cannot build %s, exit code %d", name, status)
+			continue
+		}
+		output, err := exec.Command(executable).Output()
+		if err != nil {
+			t.Errorf("Cannot run %s: %v", name, err)
+			continue
+		}
+		if string(output) != expected {
+			t.Errorf("Unexpected output of %s: %q", name, output)
+		}
+	}
+}
+
+func TestBuildSharedLibrary(t *testing.T) {
+	requireCompiler(t)
+	nm, err := exec.LookPath("nm")
+	if err != nil {
+		t.Skip("No nm to list the exported symbols")
+	}
+	dir := t.TempDir()
+	source := filepath.Join(dir, "formulas.kal")
+	program := "extern printd(x); extern randd(); private def helper(x) x; def area(w h) helper(w) * h; def noisy(x) printd(x) + randd(); def twice(n: int): int n * 2"
+	if err := ioutil.WriteFile(source, []byte(program), 0644); err != nil {
+		t.Fatal(err)
+	}
+	library, header := filepath.Join(dir, "libformulas.so"), filepath.Join(dir, "formulas.h")
+	if status := runBuild([]string{"-shared", "-emit-header", header, "-o", library, source}); status != 0 {
+		t.Fatalf("Cannot build the shared library, exit code %d", status)
+	}
+	symbols, err := exec.Command(nm, "-D", "--defined-only", "--format=just-symbols", library).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported := strings.Fields(string(symbols)); strings.Join(exported, " ") != "area noisy twice" {
+		t.Errorf("Only the functions of the program should be exported: %v", exported)
+	}
+	main := filepath.Join(dir, "main.c")
+	code := "#include \"formulas.h\"\nint main(void) { return area(2, 3) == 6 && twice(4) == 8 ? 0 : 1; }\n"
+	if err := ioutil.WriteFile(main, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	executable := filepath.Join(dir, "main")
+	compile := exec.Command(toolFromEnv("CC", "cc"), "-Werror", "main.c", "-L.", "-lformulas", "-Wl,-rpath,"+dir, "-o", executable)
+	compile.Dir = dir
+	if output, err := compile.CombinedOutput(); err != nil {
+		t.Fatalf("Cannot compile with the header: %v\n%s", err, output)
+	}
+	if err := exec.Command(executable).Run(); err != nil {
+		t.Errorf("The functions of the library returned unexpected results: %v", err)
+	}
+}
+
+func TestBuildSharedLibraryErrors(t *testing.T) {
+	requireCompiler(t)
+	dir := t.TempDir()
+	header := filepath.Join(dir, "formulas.h")
+	build := func(program string) int {
+		source := filepath.Join(dir, "formulas.kal")
+		if err := ioutil.WriteFile(source, []byte(program), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return runBuild([]string{"-shared", "-emit-header", header, "-o", filepath.Join(dir, "libformulas.so"), source})
+	}
+	for _, name := range []string{"char", "int", "exit"} {
+		if build("def "+name+"(x) x") == 0 {
+			t.Errorf("A function named %s should not be exported", name)
+		}
+	}
+	// The header is not written when the link fails.
+	defer os.Setenv("CC", os.Getenv("CC"))
+	os.Setenv("CC", "false")
+	if build("def area(w h) w * h") == 0 {
+		t.Error("The link should fail")
+	}
+	if _, err := os.Stat(header); !os.IsNotExist(err) {
+		t.Errorf("The header should not be written, received %v", err)
+	}
+}
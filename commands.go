@@ -0,0 +1,296 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/loader"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/visitor"
+)
+
+const replCommandPrefix = ":"
+
+type replCommand struct {
+	usage string
+	help  string
+	run   func(session *replSession, argument string) error
+}
+
+var replCommands map[string]replCommand
+
+func init() {
+	// Declared in init to avoid an initialization loop, :help uses the map.
+	replCommands = map[string]replCommand{
+		"help":    {"", "list the available commands", runHelpCommand},
+		"ast":     {"expr", "dump the parsed AST", runASTCommand},
+		"ir":      {"name", "show the IR of a function", runIRCommand},
+		"asm":     {"name", "show the machine code of a function", runAsmCommand},
+		"funcs":   {"", "list the defined functions and their arities", runFuncsCommand},
+		"globals": {"", "list the globals and constants with their values", runGlobalsCommand},
+		"load":    {"file.kal", "load and evaluate a file", runLoadCommand},
+		"reset":   {"", "forget all the definitions", runResetCommand},
+		"save":    {"file.kal", "save the definitions of the session", runSaveCommand},
+		"restore": {"file.kal", "reset and restore a saved session", runRestoreCommand},
+		"time":    {"expr", "evaluate and time an expression", runTimeCommand},
+		"opt":     {"on|off", "enable or disable optimizations", runOptCommand},
+	}
+}
+
+// replSession holds the state of the REPL, which survives a :reset.
+type replSession struct {
+	visitor    visitor.VisitorKaleido
+	loader     *loader.Loader
+	optimize   bool
+	transcript *transcript
+	output     io.Writer
+}
+
+func newReplSession() (*replSession, error) {
+	session := &replSession{optimize: true, output: os.Stdout}
+	if err := session.reset(); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *replSession) reset() error {
+	kaleidoVisitor, err := newVisitor()
+	if err != nil {
+		return err
+	}
+	s.visitor.Close()
+	s.visitor = kaleidoVisitor
+	s.loader = newLoader()
+	s.applyOptimization()
+	s.visitor.SetOutput(s.output)
+	return nil
+}
+
+// close releases the visitor of the session.
+func (s *replSession) close() {
+	s.visitor.Close()
+}
+
+// applyOptimization uses the pipeline given on the command line, unless
+// disabled with :opt off.
+func (s *replSession) applyOptimization() {
+	if s.optimize {
+		s.visitor.SetOptimization(optimization)
+	} else {
+		s.visitor.SetOptimization(visitor.NoOptimization)
+	}
+}
+
+func (s *replSession) setTranscript(t *transcript) {
+	s.transcript = t
+	s.output = io.MultiWriter(os.Stdout, t)
+	// The output of the programs is also logged.
+	s.visitor.SetOutput(s.output)
+}
+
+func (s *replSession) load(path string) error {
+	kaleidoAST, err := s.loader.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	return s.process(kaleidoAST)
+}
+
+// process compiles then evaluates a program resolved by the loader of the
+// session. Its imports count as loaded once it compiled, even if the
+// evaluation fails.
+func (s *replSession) process(kaleidoAST *parser.ProgramAST) error {
+	if err := feedAST(kaleidoAST, &s.visitor, s.output); err != nil {
+		return err
+	}
+	s.loader.Commit()
+	return evaluateAST(kaleidoAST, &s.visitor, s.output)
+}
+
+// parse parses an input of the REPL, and resolves its imports relatively
+// to the current directory.
+func (s *replSession) parse(input string) (*parser.ProgramAST, error) {
+	kaleidoAST, err := parse(input)
+	if err != nil {
+		return nil, err
+	}
+	return s.loader.Resolve(kaleidoAST, ".")
+}
+
+func (s *replSession) restore(path string) error {
+	if err := s.reset(); err != nil {
+		return err
+	}
+	return s.load(path)
+}
+
+func isReplCommand(input string) bool {
+	return strings.HasPrefix(strings.TrimSpace(input), replCommandPrefix)
+}
+
+func runReplCommand(session *replSession, input string) error {
+	input = strings.TrimPrefix(strings.TrimSpace(input), replCommandPrefix)
+	name, argument := input, EMPTY_STRING
+	if index := strings.IndexAny(input, " \t"); index >= 0 {
+		name, argument = input[:index], strings.TrimSpace(input[index:])
+	}
+	command, found := replCommands[name]
+	if !found {
+		return errors.New("Unknown command :" + name + ", try :help")
+	}
+	if command.usage != EMPTY_STRING && argument == EMPTY_STRING {
+		return fmt.Errorf("Usage: :%s %s", name, command.usage)
+	}
+	return command.run(session, argument)
+}
+
+func runHelpCommand(session *replSession, argument string) error {
+	names := make([]string, 0, len(replCommands))
+	for name := range replCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		command := replCommands[name]
+		fmt.Fprintf(session.output, "  %-16s %s\n", replCommandPrefix+name+" "+command.usage, command.help)
+	}
+	return nil
+}
+
+func runASTCommand(session *replSession, argument string) error {
+	kaleidoAST, err := parse(argument)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(session.output, visitor.DumpAST(kaleidoAST))
+	return nil
+}
+
+func runIRCommand(session *replSession, argument string) error {
+	ir, err := session.visitor.FunctionIR(argument)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(session.output, ir)
+	return nil
+}
+
+func runAsmCommand(session *replSession, argument string) error {
+	asm, err := session.visitor.FunctionAssembly(argument)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(session.output, asm)
+	return nil
+}
+
+func runFuncsCommand(session *replSession, argument string) error {
+	for _, function := range session.visitor.Functions() {
+		kind := "def"
+		if function.Extern {
+			kind = "extern"
+		}
+		args := make([]string, 0, len(function.Args))
+		for i, arg := range function.Args {
+			args = append(args, fmt.Sprintf("%s: %s", arg, function.ArgTypes[i]))
+		}
+		if function.Variadic {
+			args = append(args, "...")
+		}
+		fmt.Fprintf(session.output, "  %-6s %s(%s): %s arity %d\n", kind, function.Name, strings.Join(args, " "), function.ReturnType, len(function.Args))
+	}
+	return nil
+}
+
+func runGlobalsCommand(session *replSession, argument string) error {
+	for _, info := range session.visitor.Globals() {
+		global, err := session.visitor.Global(info.Name)
+		if err != nil {
+			return err
+		}
+		kind := "global"
+		if info.Const {
+			kind = "const"
+		}
+		fmt.Fprintf(session.output, "  %-6s %s = %v\n", kind, info.Name, global.Get())
+	}
+	return nil
+}
+
+func runLoadCommand(session *replSession, argument string) error {
+	return session.load(argument)
+}
+
+func runSaveCommand(session *replSession, argument string) error {
+	return saveSession(&session.visitor, argument)
+}
+
+func runRestoreCommand(session *replSession, argument string) error {
+	return session.restore(argument)
+}
+
+func runResetCommand(session *replSession, argument string) error {
+	return session.reset()
+}
+
+func runTimeCommand(session *replSession, argument string) error {
+	start := time.Now()
+	kaleidoAST, err := session.parse(argument)
+	if err != nil {
+		return err
+	}
+	if err := feedAST(kaleidoAST, &session.visitor, session.output); err != nil {
+		return err
+	}
+	session.loader.Commit()
+	compiled := time.Now()
+	if err := evaluateAST(kaleidoAST, &session.visitor, session.output); err != nil {
+		return err
+	}
+	evaluated := time.Now()
+	fmt.Fprintf(session.output, "Compilation: %v, evaluation: %v\n", compiled.Sub(start), evaluated.Sub(compiled))
+	return nil
+}
+
+func runOptCommand(session *replSession, argument string) error {
+	switch argument {
+	case "on":
+		session.optimize = true
+	case "off":
+		session.optimize = false
+	default:
+		return errors.New("Usage: :opt on|off")
+	}
+	session.applyOptimization()
+	return nil
+}
@@ -0,0 +1,353 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package engine is the API to embed the Kaleidoscope compiler and JIT in
+// a Go program.
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/kaleidort"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser/yacc"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/visitor"
+)
+
+// Engine compiles and runs Kaleidoscope code. It is safe for concurrent use:
+// Eval and Function are serialized, while the functions they return can be
+// called from many goroutines at once, including during an Eval.
+type Engine struct {
+	// mu serializes the use of the visitor.
+	mu sync.Mutex
+	// calls is held for reading while functions run, so Close waits for
+	// them before releasing the machine code.
+	calls        sync.RWMutex
+	visitor      visitor.VisitorKaleido
+	tracer       *trace.Tracer
+	optimization visitor.OptimizationConfig
+	cache        *visitor.CompilationCache
+	workers      int
+	recursion    int
+	externs      visitor.ExternPolicy
+	output       io.Writer
+	libraries    []string
+	// err is the error of the options, returned by Eval.
+	err    error
+	closed bool
+}
+
+// ErrClosed is returned when using an engine after Close.
+var ErrClosed = errors.New("engine is closed")
+
+type Option func(*Engine)
+
+// WithTracer traces the compilation and execution with the given tracer.
+// By default, nothing is traced.
+func WithTracer(tracer *trace.Tracer) Option {
+	return func(e *Engine) {
+		e.tracer = tracer
+	}
+}
+
+// WithOptimization selects the optimization passes, by default the light
+// pipeline of visitor.DefaultOptimization.
+func WithOptimization(optimization visitor.OptimizationConfig) Option {
+	return func(e *Engine) {
+		e.optimization = optimization
+	}
+}
+
+// WithCache stores the compiled functions in the directory, so they are not
+// compiled again by the next engines using the same directory.
+func WithCache(dir string) Option {
+	return func(e *Engine) {
+		e.cache = visitor.NewCompilationCache(dir)
+	}
+}
+
+// WithWorkers compiles the functions of each evaluated source with the
+// given number of goroutines. By default, they are compiled sequentially.
+func WithWorkers(workers int) Option {
+	return func(e *Engine) {
+		e.workers = workers
+	}
+}
+
+// WithRecursionLimit limits the depth of the calls, a deeper call failing
+// with a visitor.RecursionLimitError instead of exhausting the stack. By
+// default, visitor.DefaultRecursionLimit is used, 0 disables the limit.
+func WithRecursionLimit(limit int) Option {
+	return func(e *Engine) {
+		e.recursion = limit
+	}
+}
+
+// WithExterns only allows the programs to declare the given external
+// functions, WithExterns() denying all of them. By default, only the
+// functions of the runtime library are allowed, see the kaleidort package.
+func WithExterns(names ...string) Option {
+	return func(e *Engine) {
+		e.externs = visitor.AllowExterns(names...)
+	}
+}
+
+// WithOutput makes the runtime functions printing, such as putchard and
+// printd, write to the given writer instead of the standard output. The
+// writes of concurrent calls are serialized.
+func WithOutput(output io.Writer) Option {
+	return func(e *Engine) {
+		e.output = output
+	}
+}
+
+// WithLibraries loads shared libraries, such as libm.so.6, so the programs
+// can declare their functions as externs, still subject to WithExterns. The
+// libraries are searched as by dlopen, stay loaded for the whole process,
+// and a library failing to load makes Eval return the error. Unless
+// WithAnyExtern is used, the programs cannot load other libraries with
+// extern "library" f(x).
+func WithLibraries(paths ...string) Option {
+	return func(e *Engine) {
+		e.libraries = append(e.libraries, paths...)
+	}
+}
+
+// WithAnyExtern allows the programs to declare any external function, so
+// to call any function of the process. Only use it with trusted programs.
+func WithAnyExtern() Option {
+	return func(e *Engine) {
+		e.externs = nil
+	}
+}
+
+func runtimeFunctionNames() []string {
+	names := []string{}
+	for _, function := range kaleidort.Functions() {
+		names = append(names, function.Name)
+	}
+	return names
+}
+
+func New(options ...Option) *Engine {
+	engine := &Engine{
+		visitor:      visitor.NewVisitorKaleido(),
+		optimization: visitor.DefaultOptimization,
+		recursion:    visitor.DefaultRecursionLimit,
+		externs:      visitor.AllowExterns(runtimeFunctionNames()...),
+	}
+	for _, option := range options {
+		option(engine)
+	}
+	engine.visitor.SetTracer(engine.tracer)
+	engine.visitor.SetOptimization(engine.optimization)
+	engine.visitor.SetCache(engine.cache)
+	engine.visitor.SetWorkers(engine.workers)
+	engine.visitor.SetInterruptible(true)
+	engine.visitor.SetRecursionLimit(engine.recursion)
+	engine.visitor.SetExternPolicy(engine.externs)
+	engine.visitor.SetOutput(engine.output)
+	for _, library := range engine.libraries {
+		if err := engine.visitor.LoadLibrary(library); err != nil {
+			engine.err = err
+			break
+		}
+	}
+	return engine
+}
+
+// Eval compiles the source and returns the value of its last top level
+// expression, or 0 if it only contains definitions.
+func (e *Engine) Eval(source string) (float64, error) {
+	return e.EvalContext(context.Background(), source)
+}
+
+// EvalContext is Eval, the evaluation of the top level expression being
+// stopped with the error of the context once done.
+func (e *Engine) EvalContext(ctx context.Context, source string) (float64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return 0, ErrClosed
+	}
+	if e.err != nil {
+		return 0, e.err
+	}
+	program, err := yacc.BuildKaleidoASTWithTracer(source, e.tracer)
+	if err != nil {
+		return 0, err
+	}
+	if err := e.visitor.FeedAST(program); err != nil {
+		return 0, err
+	}
+	if !program.HasTopLevelExpr() {
+		return 0, nil
+	}
+	main, err := e.visitor.CompiledFunction(parser.MainFunctionName)
+	if err != nil {
+		return 0, err
+	}
+	return main.CallContext(ctx)
+}
+
+// Close releases the LLVM context, the JIT and the compiled code of the
+// engine. Each engine owns its own context, so closing one does not affect
+// the others. Close can be called several times.
+func (e *Engine) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls.Lock()
+	defer e.calls.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	e.visitor.Close()
+}
+
+// RegisterFunc makes a Go function callable from the programs, for instance
+// RegisterFunc("lookup", func(a, b float64) float64 { ... }) for a program
+// declaring extern lookup(a b). The function must take float64 arguments
+// and return a float64. As the functions of the engine, it can be called
+// from several goroutines at once, but it must not call Eval. A panic stops
+// the call with an error.
+func (e *Engine) RegisterFunc(name string, fn interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	return e.visitor.RegisterFunc(name, fn)
+}
+
+// Function is a compiled function, which can be called concurrently.
+type Function struct {
+	engine   *Engine
+	compiled *visitor.CompiledFunction
+}
+
+// Function returns the function with the given name. Its calls run the
+// latest definition with the same number of arguments, so they pick up the
+// redefinitions evaluated later.
+func (e *Engine) Function(name string) (*Function, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	compiled, err := e.visitor.CompiledFunction(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Function{engine: e, compiled: compiled}, nil
+}
+
+// Arity returns the number of arguments of the function.
+func (f *Function) Arity() int {
+	return f.compiled.Arity()
+}
+
+// Call runs the function with the given arguments.
+func (f *Function) Call(args ...float64) (float64, error) {
+	f.engine.calls.RLock()
+	defer f.engine.calls.RUnlock()
+	if f.engine.closed {
+		return 0, ErrClosed
+	}
+	return f.compiled.Call(args...)
+}
+
+// CallContext runs the function with the given arguments, and stops it with
+// the error of the context once done, for instance context.DeadlineExceeded.
+func (f *Function) CallContext(ctx context.Context, args ...float64) (float64, error) {
+	f.engine.calls.RLock()
+	defer f.engine.calls.RUnlock()
+	if f.engine.closed {
+		return 0, ErrClosed
+	}
+	return f.compiled.CallContext(ctx, args...)
+}
+
+// CallContext runs the function with the given name, see Function.CallContext.
+func (e *Engine) CallContext(ctx context.Context, name string, args ...float64) (float64, error) {
+	function, err := e.Function(name)
+	if err != nil {
+		return 0, err
+	}
+	return function.CallContext(ctx, args...)
+}
+
+// Global is a variable declared with global or const by the programs of an
+// engine. It can be read and written while functions run.
+type Global struct {
+	engine *Engine
+	global *visitor.Global
+}
+
+// Global returns the global or constant with the given name. A later
+// declaration of the same global, for instance global x = 1 in Eval, changes
+// the value seen by the handle.
+func (e *Engine) Global(name string) (*Global, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	global, err := e.visitor.Global(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Global{engine: e, global: global}, nil
+}
+
+// Const tells if the variable is a constant, which cannot be changed.
+func (g *Global) Const() bool {
+	return g.global.Const()
+}
+
+// Get returns the current value of the variable.
+func (g *Global) Get() (float64, error) {
+	g.engine.calls.RLock()
+	defer g.engine.calls.RUnlock()
+	if g.engine.closed {
+		return 0, ErrClosed
+	}
+	return g.global.Get(), nil
+}
+
+// Set changes the value of a global, the running functions seeing it from
+// their next read. Constants are folded into the compiled code, so they
+// cannot be changed.
+func (g *Global) Set(value float64) error {
+	g.engine.calls.RLock()
+	defer g.engine.calls.RUnlock()
+	if g.engine.closed {
+		return ErrClosed
+	}
+	return g.global.Set(value)
+}
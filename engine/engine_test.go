@@ -0,0 +1,404 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/visitor"
+)
+
+func TestEval(t *testing.T) {
+	engine := New()
+	if _, err := engine.Eval("def double(x) x * 2"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := engine.Eval("double(21)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != 42 {
+		t.Errorf("Was waiting for 42 but received %v", result)
+	}
+	if _, err := engine.Eval("unknown(1)"); err == nil {
+		t.Error("Was waiting for an error")
+	}
+}
+
+func TestWithTracer(t *testing.T) {
+	var output strings.Builder
+	tracer := trace.New(&output)
+	tracer.Enable(trace.LevelInfo, trace.Codegen)
+	engine := New(WithTracer(tracer))
+	if _, err := engine.Eval("def one() 1"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "[codegen] Function one compiled") {
+		t.Errorf("Missing codegen trace in: %q", output.String())
+	}
+	if strings.Contains(output.String(), "[parser]") {
+		t.Errorf("Parser category should not be traced: %q", output.String())
+	}
+}
+
+func TestClose(t *testing.T) {
+	first, second := New(), New()
+	defer second.Close()
+	for _, engine := range []*Engine{first, second} {
+		if _, err := engine.Eval("def f(x) x + 1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first.Close()
+	first.Close()
+	if _, err := first.Eval("f(1)"); err != ErrClosed {
+		t.Errorf("Was waiting for ErrClosed but received %v", err)
+	}
+	result, err := second.Eval("f(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != 2 {
+		t.Errorf("Was waiting for 2 but received %v", result)
+	}
+}
+
+func TestFunction(t *testing.T) {
+	engine := New()
+	defer engine.Close()
+	if _, err := engine.Function("add"); err == nil {
+		t.Error("Was waiting for an error")
+	}
+	if _, err := engine.Eval("def add(x y) x + y"); err != nil {
+		t.Fatal(err)
+	}
+	add, err := engine.Function("add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := add.Call(40, 2); err != nil || result != 42 {
+		t.Errorf("Was waiting for 42 but received %v, %v", result, err)
+	}
+	if _, err := add.Call(1); err == nil {
+		t.Error("Was waiting for an error")
+	}
+	if _, err := engine.Eval("def add(x y) x - y"); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := add.Call(40, 2); err != nil || result != 38 {
+		t.Errorf("Was waiting for the redefinition, but received %v, %v", result, err)
+	}
+	engine.Close()
+	if _, err := add.Call(40, 2); err != ErrClosed {
+		t.Errorf("Was waiting for ErrClosed but received %v", err)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	const redefinitions = 50
+	engine := New()
+	defer engine.Close()
+	if _, err := engine.Eval("def step() 0\ndef f(x) x + step()"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := engine.Function("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				result, err := f.Call(1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if step := result - 1; step < 0 || step > redefinitions || step != float64(int(step)) {
+					t.Errorf("Unexpected result %v", result)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < redefinitions; j++ {
+				name := "g" + strconv.Itoa(i) + "v" + strconv.Itoa(j)
+				if _, err := engine.Eval("def " + name + "(x) x * 2\n" + name + "(2)"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 1; i <= redefinitions; i++ {
+		if _, err := engine.Eval("def step() " + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if result, err := f.Call(1); err != nil || result != redefinitions+1 {
+		t.Errorf("Was waiting for %v but received %v, %v", redefinitions+1, result, err)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	engine := New()
+	defer engine.Close()
+	// Too many calls to end before the deadline, with a depth of ten.
+	program := "def f0(x) x + 1\n"
+	for level := 1; level < 10; level++ {
+		program += fmt.Sprintf("def f%d(x) %s0\n", level, strings.Repeat(fmt.Sprintf("f%d(x) + ", level-1), 8))
+	}
+	if _, err := engine.Eval(program + "def f(x) f9(x)\ndef double(x) x * 2"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := engine.CallContext(ctx, "f", 1); err != context.DeadlineExceeded {
+		t.Errorf("Was waiting for the deadline but received %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := engine.EvalContext(ctx, "f(2)"); err != context.DeadlineExceeded {
+		t.Errorf("Was waiting for the deadline but received %v", err)
+	}
+	result, err := engine.CallContext(context.Background(), "double", 21)
+	if err != nil || result != 42 {
+		t.Errorf("Was waiting for 42 but received %v, %v", result, err)
+	}
+}
+
+func TestRecursionLimit(t *testing.T) {
+	for _, limit := range []int{visitor.DefaultRecursionLimit, 50} {
+		engine := New(WithRecursionLimit(limit))
+		_, err := engine.Eval("def deep(x) deep(x) + 1; deep(0)")
+		var limitErr *visitor.RecursionLimitError
+		if !errors.As(err, &limitErr) || limitErr.Function != "deep" || limitErr.Limit != limit {
+			t.Errorf("Was waiting for the recursion limit %d, received %v", limit, err)
+		}
+		engine.Close()
+	}
+}
+
+func TestExterns(t *testing.T) {
+	tests := []struct {
+		options []Option
+		source  string
+		allowed bool
+	}{
+		{nil, "extern sin(x); sin(0)", true},
+		{nil, "extern system(x);", false},
+		{nil, "extern printd(x); extern randd(); printd(randd())", true},
+		{[]Option{WithExterns()}, "extern sin(x);", false},
+		{[]Option{WithExterns("cos")}, "extern cos(x); cos(0)", true},
+		{[]Option{WithAnyExtern()}, "extern getpid();", true},
+		{[]Option{WithExterns("cbrt")}, `extern "libm.so.6" cbrt(x);`, false},
+		{[]Option{WithLibraries("libm.so.6"), WithExterns("cbrt")}, `extern "libm.so.6" cbrt(x); cbrt(8)`, true},
+	}
+	for _, test := range tests {
+		engine := New(test.options...)
+		_, err := engine.Eval(test.source)
+		if test.allowed && err != nil {
+			t.Errorf("%q should be allowed: %v", test.source, err)
+		}
+		if !test.allowed && (err == nil || !strings.Contains(err.Error(), "not allowed")) {
+			t.Errorf("%q should not be allowed, received %v", test.source, err)
+		}
+		engine.Close()
+	}
+}
+
+func TestWithLibraries(t *testing.T) {
+	engine := New(WithLibraries("libm.so.6", "libkaleidomissing.so"))
+	defer engine.Close()
+	if _, err := engine.Eval("1"); err == nil || !strings.Contains(err.Error(), "libkaleidomissing.so") {
+		t.Errorf("The library failing to load should be reported, received %v", err)
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	engine := New(WithExterns())
+	defer engine.Close()
+	var lookups int64
+	table := []float64{10, 20, 30}
+	err := engine.RegisterFunc("lookup", func(row, offset float64) float64 {
+		atomic.AddInt64(&lookups, 1)
+		return table[int(row)] + offset
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.Eval("extern lookup(row offset); def f(x) lookup(x, 0.5)"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := engine.Function("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(row int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				result, err := f.Call(float64(row % 3))
+				if err != nil || result != table[row%3]+0.5 {
+					t.Errorf("Was waiting for %v but received %v, %v", table[row%3]+0.5, result, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if lookups != 800 {
+		t.Errorf("Was waiting for 800 lookups but counted %d", lookups)
+	}
+	if _, err := engine.Eval("lookup(5, 0)"); err == nil || !strings.Contains(err.Error(), "index out of range") {
+		t.Errorf("Was waiting for the panic of lookup, received %v", err)
+	}
+}
+
+func TestWithOutput(t *testing.T) {
+	var first, second strings.Builder
+	engines := []*Engine{New(WithOutput(&first)), New(WithOutput(&second))}
+	for i, engine := range engines {
+		defer engine.Close()
+		if _, err := engine.Eval("extern printd(x); def show(x) printd(x)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := engine.Eval("show(" + strconv.Itoa(i) + ")"); err != nil {
+			t.Fatal(err)
+		}
+		show, err := engine.Function("show")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := show.Call(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.String() != "0.000000\n10.000000\n" || second.String() != "1.000000\n10.000000\n" {
+		t.Errorf("Unexpected outputs %q and %q", first.String(), second.String())
+	}
+}
+
+// residentMemory returns the resident memory of the process in bytes.
+func residentMemory(t *testing.T) int {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		t.Skip("Resident memory not available:", err)
+	}
+	fields := strings.Fields(string(data))
+	pages, err := strconv.Atoi(fields[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pages * os.Getpagesize()
+}
+
+func runSession(t *testing.T) {
+	engine := New()
+	defer engine.Close()
+	for _, source := range []string{"def f(x) x * 2", "def f(x) x * 3", "f(2)", "f(3)"} {
+		if _, err := engine.Eval(source); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestManySessionsDoNotLeak(t *testing.T) {
+	sessions := 3000
+	if testing.Short() {
+		sessions = 300
+	}
+	for i := 0; i < sessions/10; i++ {
+		runSession(t)
+	}
+	before := residentMemory(t)
+	for i := 0; i < sessions; i++ {
+		runSession(t)
+	}
+	after := residentMemory(t)
+	t.Logf("Resident memory: %d KiB before, %d KiB after", before>>10, after>>10)
+	if growth := after - before; growth > 16<<20 {
+		t.Errorf("Resident memory grew by %d KiB over %d sessions", growth>>10, sessions)
+	}
+}
+
+func TestGlobal(t *testing.T) {
+	engine := New()
+	defer engine.Close()
+	if _, err := engine.Eval("global rate = 2; const offset = 1; def apply(x) x * rate + offset"); err != nil {
+		t.Fatal(err)
+	}
+	rate, err := engine.Global("rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rate.Set(3); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := engine.Eval("apply(10)"); err != nil || result != 31 {
+		t.Errorf("Was waiting for 31 but received %v, %v", result, err)
+	}
+	if _, err := engine.Eval("global rate = 5"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := rate.Get(); err != nil || value != 5 {
+		t.Errorf("Was waiting for 5 but received %v, %v", value, err)
+	}
+	offset, err := engine.Global("offset")
+	if err != nil || !offset.Const() || offset.Set(2) == nil {
+		t.Error("offset should be a constant:", err)
+	}
+	engine.Close()
+	if _, err := rate.Get(); err != ErrClosed {
+		t.Errorf("Was waiting for ErrClosed but received %v", err)
+	}
+}
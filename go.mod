@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/llvm/llvm-project v0.0.0-00010101000000-000000000000
+	github.com/peterh/liner v1.2.1
 	golang.org/x/tools v0.1.0
 )
 
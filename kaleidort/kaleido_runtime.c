@@ -0,0 +1,112 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+#include "kaleido_runtime.h"
+
+#include <stdint.h>
+#include <stdio.h>
+#include <string.h>
+#include <time.h>
+
+static void write_stdout(const char *data, size_t size) {
+	fwrite(data, 1, size, stdout);
+}
+
+static kaleido_writer writer = write_stdout;
+
+void kaleido_set_writer(kaleido_writer new_writer) {
+	writer = new_writer != NULL ? new_writer : write_stdout;
+}
+
+double putchard(double c) {
+	char character = (unsigned char)c;
+	writer(&character, 1);
+	return 0;
+}
+
+double printd(double x) {
+	// Large enough for the 309 digits of the largest double.
+	char buffer[400];
+	int size = snprintf(buffer, sizeof(buffer), "%f\n", x);
+	if (size >= (int)sizeof(buffer)) {
+		size = sizeof(buffer) - 1;
+	}
+	if (size > 0) {
+		writer(buffer, size);
+	}
+	return 0;
+}
+
+double nowd(void) {
+	struct timespec now;
+	clock_gettime(CLOCK_MONOTONIC, &now);
+	return (double)now.tv_sec + (double)now.tv_nsec / 1e9;
+}
+
+#define RANDOM_SEED 0x9E3779B97F4A7C15ULL
+
+// The state of the xorshift64* generator, which must not be 0. It is shared
+// by the threads, so it is updated atomically. A program can get its own
+// state from the random source.
+static uint64_t shared_random_state = RANDOM_SEED;
+
+static kaleido_random_source random_source = NULL;
+
+void kaleido_set_random_source(kaleido_random_source source) {
+	random_source = source;
+}
+
+void kaleido_random_init(uint64_t *state) {
+	*state = RANDOM_SEED;
+}
+
+static uint64_t *random_state(void) {
+	uint64_t *state = random_source != NULL ? random_source() : NULL;
+	return state != NULL ? state : &shared_random_state;
+}
+
+double srandd(double seed) {
+	uint64_t bits;
+	memcpy(&bits, &seed, sizeof(bits));
+	bits ^= RANDOM_SEED;
+	if (bits == 0) {
+		bits = RANDOM_SEED;
+	}
+	__atomic_store_n(random_state(), bits, __ATOMIC_RELAXED);
+	return 0;
+}
+
+double randd(void) {
+	uint64_t *random = random_state();
+	uint64_t state = __atomic_load_n(random, __ATOMIC_RELAXED);
+	uint64_t next;
+	do {
+		next = state;
+		next ^= next >> 12;
+		next ^= next << 25;
+		next ^= next >> 27;
+	} while (!__atomic_compare_exchange_n(random, &state, next, 1, __ATOMIC_RELAXED, __ATOMIC_RELAXED));
+	// The 53 upper bits of the output fill the mantissa of a double.
+	return (double)((next * 0x2545F4914F6CDD1DULL) >> 11) / 9007199254740992.0;
+}
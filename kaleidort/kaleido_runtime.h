@@ -0,0 +1,70 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// The runtime library of Kaleidoscope programs. All the functions take and
+// return doubles, so they can be declared with extern.
+
+#ifndef KALEIDO_RUNTIME_H
+#define KALEIDO_RUNTIME_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+// kaleido_writer writes the output of the programs.
+typedef void (*kaleido_writer)(const char *data, size_t size);
+
+// kaleido_set_writer replaces the function writing the output of the
+// programs, NULL restoring the standard output.
+void kaleido_set_writer(kaleido_writer writer);
+
+// kaleido_random_source returns the state of the random numbers of the
+// current program, NULL for the state shared by the process.
+typedef uint64_t *(*kaleido_random_source)(void);
+
+// kaleido_set_random_source replaces the function returning the state of
+// the random numbers, NULL restoring the state shared by the process.
+void kaleido_set_random_source(kaleido_random_source source);
+
+// kaleido_random_init sets a state of the random numbers as before any
+// call to srandd.
+void kaleido_random_init(uint64_t *state);
+
+// putchard writes the character with the given code, and returns 0.
+double putchard(double c);
+
+// printd writes the number followed by a new line, and returns 0.
+double printd(double x);
+
+// nowd returns the time in seconds from an arbitrary point, which never
+// goes backward.
+double nowd(void);
+
+// srandd seeds the random numbers returned by randd, and returns 0. A seed
+// always gives the same numbers, whatever the machine.
+double srandd(double seed);
+
+// randd returns a random number between 0 included and 1 excluded.
+double randd(void);
+
+#endif
@@ -0,0 +1,149 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package kaleidort is the runtime library of the Kaleidoscope programs:
+// printing, clock and seeded random numbers, plus the math functions of the
+// C library. The JIT maps these functions itself, so a program behaves the
+// same whatever the symbols exported by the process. For ahead of time
+// compilation, the C sources are built into a static library.
+package kaleidort
+
+/*
+#cgo LDFLAGS: -lm
+#include <math.h>
+#include <stdlib.h>
+#include "kaleido_runtime.h"
+
+typedef struct {
+	const char *name;
+	int arity;
+	void *address;
+} kaleido_function;
+
+static const kaleido_function kaleido_functions[] = {
+	{"putchard", 1, (void *)putchard},
+	{"printd", 1, (void *)printd},
+	{"nowd", 0, (void *)nowd},
+	{"srandd", 1, (void *)srandd},
+	{"randd", 0, (void *)randd},
+	{"acos", 1, (void *)acos},
+	{"asin", 1, (void *)asin},
+	{"atan", 1, (void *)atan},
+	{"atan2", 2, (void *)atan2},
+	{"cbrt", 1, (void *)cbrt},
+	{"ceil", 1, (void *)ceil},
+	{"cos", 1, (void *)cos},
+	{"cosh", 1, (void *)cosh},
+	{"exp", 1, (void *)exp},
+	{"exp2", 1, (void *)exp2},
+	{"fabs", 1, (void *)fabs},
+	{"floor", 1, (void *)floor},
+	{"fmax", 2, (void *)fmax},
+	{"fmin", 2, (void *)fmin},
+	{"fmod", 2, (void *)fmod},
+	{"hypot", 2, (void *)hypot},
+	{"log", 1, (void *)log},
+	{"log10", 1, (void *)log10},
+	{"log2", 1, (void *)log2},
+	{"pow", 2, (void *)pow},
+	{"round", 1, (void *)round},
+	{"sin", 1, (void *)sin},
+	{"sinh", 1, (void *)sinh},
+	{"sqrt", 1, (void *)sqrt},
+	{"tan", 1, (void *)tan},
+	{"tanh", 1, (void *)tanh},
+	{"trunc", 1, (void *)trunc},
+};
+
+static int kaleido_function_count(void) {
+	return sizeof(kaleido_functions) / sizeof(kaleido_functions[0]);
+}
+
+static const kaleido_function *kaleido_function_at(int i) {
+	return &kaleido_functions[i];
+}
+*/
+import "C"
+
+import (
+	"embed"
+	"unsafe"
+)
+
+// Sources are the C sources of the runtime library, to build the static
+// library linked with the programs compiled ahead of time.
+//
+//go:embed kaleido_runtime.c kaleido_runtime.h
+var Sources embed.FS
+
+// Function is a function of the runtime library, callable from Kaleidoscope
+// once declared with extern.
+type Function struct {
+	Name    string
+	Arity   int
+	Address unsafe.Pointer
+}
+
+// SetWriter replaces the C function writing the output of the programs, a
+// kaleido_writer declared by kaleido_runtime.h. Nil restores the standard
+// output.
+func SetWriter(writer unsafe.Pointer) {
+	C.kaleido_set_writer(C.kaleido_writer(writer))
+}
+
+// SetRandomSource replaces the C function returning the state of the random
+// numbers of the current program, a kaleido_random_source declared by
+// kaleido_runtime.h. Nil restores the state shared by the process.
+func SetRandomSource(source unsafe.Pointer) {
+	C.kaleido_set_random_source(C.kaleido_random_source(source))
+}
+
+// NewRandomState allocates a state of the random numbers out of the Go
+// heap, to be returned by the random source. It must be released with
+// FreeRandomState.
+func NewRandomState() unsafe.Pointer {
+	state := (*C.uint64_t)(C.malloc(C.sizeof_uint64_t))
+	C.kaleido_random_init(state)
+	return unsafe.Pointer(state)
+}
+
+// FreeRandomState releases a state allocated by NewRandomState.
+func FreeRandomState(state unsafe.Pointer) {
+	C.free(state)
+}
+
+// Functions returns the functions of the runtime library.
+func Functions() []Function {
+	count := int(C.kaleido_function_count())
+	functions := make([]Function, 0, count)
+	for i := 0; i < count; i++ {
+		function := C.kaleido_function_at(C.int(i))
+		functions = append(functions, Function{
+			Name:    C.GoString(function.name),
+			Arity:   int(function.arity),
+			Address: function.address,
+		})
+	}
+	return functions
+}
@@ -0,0 +1,128 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package kaleidort_test
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/engine"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/kaleidort"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/visitor"
+)
+
+func TestFunctions(t *testing.T) {
+	arities := map[string]int{}
+	for _, function := range kaleidort.Functions() {
+		if function.Address == nil {
+			t.Errorf("Function %s has no address", function.Name)
+		}
+		arities[function.Name] = function.Arity
+	}
+	for _, name := range visitor.MathExterns {
+		if _, found := arities[name]; !found {
+			t.Errorf("Math function %s is missing from the runtime", name)
+		}
+	}
+	if arities["putchard"] != 1 || arities["randd"] != 0 || arities["pow"] != 2 {
+		t.Errorf("Unexpected arities: %v", arities)
+	}
+}
+
+func TestSeededRandom(t *testing.T) {
+	draw := func() [2]float64 {
+		e := engine.New()
+		defer e.Close()
+		if _, err := e.Eval("extern srandd(seed); extern randd(); srandd(42)"); err != nil {
+			t.Fatal(err)
+		}
+		values := [2]float64{}
+		for i := range values {
+			value, err := e.Eval("randd()")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value < 0 || value >= 1 {
+				t.Errorf("Random number %v out of [0, 1)", value)
+			}
+			values[i] = value
+		}
+		return values
+	}
+	first, second := draw(), draw()
+	if first != second || first[0] == first[1] {
+		t.Errorf("Was waiting for the same sequence after the same seed: %v and %v", first, second)
+	}
+}
+
+func TestRandomPerEngine(t *testing.T) {
+	const count = 1000
+	draws := func(e *engine.Engine, seed int) []float64 {
+		if _, err := e.Eval(fmt.Sprintf("extern srandd(seed); extern randd(); def draw() randd(); srandd(%d)", seed)); err != nil {
+			t.Error(err)
+			return nil
+		}
+		draw, err := e.Function("draw")
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		values := make([]float64, count)
+		for i := range values {
+			value, err := draw.Call()
+			if err != nil {
+				t.Error(err)
+				return nil
+			}
+			values[i] = value
+		}
+		return values
+	}
+	expected := make([][]float64, 2)
+	for i := range expected {
+		e := engine.New()
+		expected[i] = draws(e, i+1)
+		e.Close()
+	}
+	engines := []*engine.Engine{engine.New(), engine.New()}
+	results := make([][]float64, len(engines))
+	var wg sync.WaitGroup
+	for i := range engines {
+		defer engines[i].Close()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = draws(engines[i], i+1)
+		}(i)
+	}
+	wg.Wait()
+	for i := range results {
+		if !reflect.DeepEqual(results[i], expected[i]) {
+			t.Errorf("Engine %d did not draw its own sequence while the other engine was drawing", i)
+		}
+	}
+}
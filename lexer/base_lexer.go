@@ -67,10 +67,18 @@ func newErrorBadRune(message string, args ...interface{}) error {
 type BaseLexer struct {
 	pos    int
 	buffer string
+	// line and column of the next rune, starting at 1.
+	line   int
+	column int
 }
 
 func NewBaseLexer(data string) BaseLexer {
-	return BaseLexer{pos: 0, buffer: data}
+	return BaseLexer{pos: 0, buffer: data, line: 1, column: 1}
+}
+
+// Position returns the line and column of the next rune, starting at 1.
+func (l BaseLexer) Position() (line int, column int) {
+	return l.line, l.column
 }
 
 func (l BaseLexer) PeekNext() (rune, error) {
@@ -87,6 +95,12 @@ func (l *BaseLexer) ConsumeNext() (rune, error) {
 	}
 	val, width := utf8.DecodeRuneInString(l.buffer[l.pos:])
 	l.pos += width
+	if val == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
 	return val, nil
 }
 
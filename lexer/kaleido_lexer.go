@@ -25,6 +25,8 @@ SOFTWARE.
 package lexer
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -38,6 +40,12 @@ const (
 	KTokenIdentifier
 	KTokenNumber
 	KTokenSymbol
+	KTokenImport
+	KTokenPrivate
+	KTokenString
+	KTokenGlobal
+	KTokenConst
+	KTokenError
 )
 
 type KaleidoTokenContext struct {
@@ -65,12 +73,40 @@ func emitNumber(val string) *KaleidoTokenContext {
 	return &KaleidoTokenContext{Token: KTokenNumber, Value: val}
 }
 
+func emitImport() *KaleidoTokenContext {
+	return &KaleidoTokenContext{Token: KTokenImport, Value: ""}
+}
+
+func emitPrivate() *KaleidoTokenContext {
+	return &KaleidoTokenContext{Token: KTokenPrivate, Value: ""}
+}
+
+func emitString(val string) *KaleidoTokenContext {
+	return &KaleidoTokenContext{Token: KTokenString, Value: val}
+}
+
+func emitGlobal() *KaleidoTokenContext {
+	return &KaleidoTokenContext{Token: KTokenGlobal, Value: ""}
+}
+
+func emitConst() *KaleidoTokenContext {
+	return &KaleidoTokenContext{Token: KTokenConst, Value: ""}
+}
+
+// emitError returns a token reporting an invalid input, described by its
+// value.
+func emitError(message string) *KaleidoTokenContext {
+	return &KaleidoTokenContext{Token: KTokenError, Value: message}
+}
+
 func emitSymbol(val rune) *KaleidoTokenContext {
 	return &KaleidoTokenContext{Token: KTokenSymbol, Value: string(val)}
 }
 
 type KaleidoLexer struct {
 	BaseLexer
+	tokenLine   int
+	tokenColumn int
 }
 
 func NewKaleidoLexer(data string) KaleidoLexer {
@@ -80,6 +116,7 @@ func NewKaleidoLexer(data string) KaleidoLexer {
 func (l *KaleidoLexer) NextToken() *KaleidoTokenContext {
 	for {
 		l.ConsumeWhitespaces()
+		l.tokenLine, l.tokenColumn = l.Position()
 		val, err := l.PeekNext()
 		switch {
 		case err != nil:
@@ -91,6 +128,14 @@ func (l *KaleidoLexer) NextToken() *KaleidoTokenContext {
 				return emitDef()
 			case "extern":
 				return emitExtern()
+			case "import":
+				return emitImport()
+			case "private":
+				return emitPrivate()
+			case "global":
+				return emitGlobal()
+			case "const":
+				return emitConst()
 			default:
 				return emitIdentifier(result)
 			}
@@ -99,6 +144,13 @@ func (l *KaleidoLexer) NextToken() *KaleidoTokenContext {
 			return emitNumber(result)
 		case val == '#':
 			l.consumeGreedCommentLine()
+		case val == '"':
+			l.ConsumeNext()
+			result, err := l.consumeString()
+			if err != nil {
+				return emitError(err.Error())
+			}
+			return emitString(result)
 		default:
 			l.ConsumeNext()
 			return emitSymbol(val)
@@ -107,6 +159,12 @@ func (l *KaleidoLexer) NextToken() *KaleidoTokenContext {
 	}
 }
 
+// TokenPosition returns the line and column where the last token returned
+// by NextToken starts.
+func (l *KaleidoLexer) TokenPosition() (line int, column int) {
+	return l.tokenLine, l.tokenColumn
+}
+
 func (l *KaleidoLexer) consumeGreedCommentLine() {
 	for {
 		val, err := l.PeekNext()
@@ -120,6 +178,40 @@ func (l *KaleidoLexer) consumeGreedCommentLine() {
 	}
 }
 
+// UnterminatedString is the value of the error token of a string missing
+// its closing quote, which more input may complete.
+const UnterminatedString = "unterminated string"
+
+// consumeString reads a string up to its closing quote, which is consumed.
+// The escape sequences are \n, \t, \\ and \", any other one is an error.
+func (l *KaleidoLexer) consumeString() (string, error) {
+	var builder strings.Builder
+	for {
+		char, err := l.ConsumeNext()
+		if err != nil {
+			return "", errors.New(UnterminatedString)
+		}
+		if char == '"' {
+			return builder.String(), nil
+		}
+		if char == '\\' {
+			if char, err = l.ConsumeNext(); err != nil {
+				return "", errors.New(UnterminatedString)
+			}
+			switch char {
+			case 'n':
+				char = '\n'
+			case 't':
+				char = '\t'
+			case '\\', '"':
+			default:
+				return "", fmt.Errorf("unknown escape sequence \\%c in string", char)
+			}
+		}
+		builder.WriteRune(char)
+	}
+}
+
 func (l *KaleidoLexer) consumeGreedAlphanum() string {
 	var builder strings.Builder
 	for {
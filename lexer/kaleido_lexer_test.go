@@ -25,6 +25,7 @@ SOFTWARE.
 package lexer
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -51,3 +52,74 @@ func TestValidMedley(t *testing.T) {
 	}
 
 }
+
+func TestImportAndString(t *testing.T) {
+	input := `import "lib/math.kal"; private def importer "unterminated`
+	targetResults := []KaleidoTokenContext{
+		{KTokenImport, ""},
+		{KTokenString, "lib/math.kal"},
+		{KTokenSymbol, ";"},
+		{KTokenPrivate, ""},
+		{KTokenDef, ""},
+		{KTokenIdentifier, "importer"},
+		{KTokenError, "unterminated string"},
+	}
+	lexer := NewKaleidoLexer(input)
+	for i := 0; i < len(targetResults); i++ {
+		result := lexer.NextToken()
+		if result.Token != targetResults[i].Token || result.Value != targetResults[i].Value {
+			t.Fatalf("Was waiting for: %v but received: %v", &targetResults[i], result)
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	lexer := NewKaleidoLexer(`"a\tb\n\"c\"\\"`)
+	if result := lexer.NextToken(); result.Token != KTokenString || result.Value != "a\tb\n\"c\"\\" {
+		t.Errorf("Unexpected string: %v", result)
+	}
+}
+
+func TestUnknownEscapes(t *testing.T) {
+	for _, input := range []string{`"\x41"`, `"\0"`, `"a\qb"`} {
+		lexer := NewKaleidoLexer(input)
+		if result := lexer.NextToken(); result.Token != KTokenError || !strings.Contains(result.Value, "unknown escape sequence") {
+			t.Errorf("Was waiting for an unknown escape error with %s, received %v", input, result)
+		}
+	}
+}
+
+func TestGlobalAndConst(t *testing.T) {
+	input := "global x = 3.0; const pi = 3.14159 globals"
+	targetResults := []KaleidoTokenContext{
+		{KTokenGlobal, ""},
+		{KTokenIdentifier, "x"},
+		{KTokenSymbol, "="},
+		{KTokenNumber, "3.0"},
+		{KTokenSymbol, ";"},
+		{KTokenConst, ""},
+		{KTokenIdentifier, "pi"},
+		{KTokenSymbol, "="},
+		{KTokenNumber, "3.14159"},
+		{KTokenIdentifier, "globals"},
+		{KTokenEOF, ""},
+	}
+	lexer := NewKaleidoLexer(input)
+	for i := 0; i < len(targetResults); i++ {
+		result := lexer.NextToken()
+		if result.Token != targetResults[i].Token || result.Value != targetResults[i].Value {
+			t.Fatalf("Was waiting for: %v but received: %v", &targetResults[i], result)
+		}
+	}
+}
+
+func TestTokenPosition(t *testing.T) {
+	lexer := NewKaleidoLexer("def f(x)\n  # comment\n  x + 1")
+	targetPositions := [][2]int{{1, 1}, {1, 5}, {1, 6}, {1, 7}, {1, 8}, {3, 3}, {3, 5}, {3, 7}}
+	for _, target := range targetPositions {
+		lexer.NextToken()
+		if line, column := lexer.TokenPosition(); line != target[0] || column != target[1] {
+			t.Fatalf("Was waiting for %d:%d but received %d:%d", target[0], target[1], line, column)
+		}
+	}
+}
@@ -14,11 +14,17 @@ func _() {
 	_ = x[KTokenIdentifier-3]
 	_ = x[KTokenNumber-4]
 	_ = x[KTokenSymbol-5]
+	_ = x[KTokenImport-6]
+	_ = x[KTokenPrivate-7]
+	_ = x[KTokenString-8]
+	_ = x[KTokenGlobal-9]
+	_ = x[KTokenConst-10]
+	_ = x[KTokenError-11]
 }
 
-const _KaleidoToken_name = "KTokenEOFKTokenDefKTokenExternKTokenIdentifierKTokenNumberKTokenSymbol"
+const _KaleidoToken_name = "KTokenEOFKTokenDefKTokenExternKTokenIdentifierKTokenNumberKTokenSymbolKTokenImportKTokenPrivateKTokenStringKTokenGlobalKTokenConstKTokenError"
 
-var _KaleidoToken_index = [...]uint8{0, 9, 18, 30, 46, 58, 70}
+var _KaleidoToken_index = [...]uint8{0, 9, 18, 30, 46, 58, 70, 82, 95, 107, 119, 130, 141}
 
 func (i KaleidoToken) String() string {
 	if i < 0 || i >= KaleidoToken(len(_KaleidoToken_index)-1) {
@@ -0,0 +1,178 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package loader resolves the imports of Kaleidoscope programs, so a program
+// can be split across several files.
+package loader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser/yacc"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
+)
+
+// Loader replaces the imports of programs by the definitions of the imported
+// files. A file is only loaded once during the life of the loader, so a
+// Loader must live as long as the visitor it feeds. The files imported by a
+// program only count as loaded once committed, after the program compiled.
+type Loader struct {
+	searchPath []string
+	tracer     *trace.Tracer
+	loaded     map[string]bool
+	pending    map[string]bool
+}
+
+// New returns a loader looking up imports relatively to the importing file,
+// then in the directories of the search path. The tracer may be nil.
+func New(searchPath []string, tracer *trace.Tracer) *Loader {
+	return &Loader{searchPath: searchPath, tracer: tracer, loaded: make(map[string]bool)}
+}
+
+// LoadFile parses a main program file and resolves its imports. The file
+// itself can be loaded again, for instance to replace its definitions.
+func (l *Loader) LoadFile(path string) (*parser.ProgramAST, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	program, err := l.parseFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+	return l.resolve(program, filepath.Dir(absPath), []string{absPath})
+}
+
+// Resolve returns the program preceded by the definitions of its imports,
+// relative imports being looked up from dir. Files already loaded are
+// skipped.
+func (l *Loader) Resolve(program *parser.ProgramAST, dir string) (*parser.ProgramAST, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return l.resolve(program, absDir, nil)
+}
+
+func (l *Loader) resolve(program *parser.ProgramAST, dir string, stack []string) (*parser.ProgramAST, error) {
+	pending := make(map[string]bool)
+	result := &parser.ProgramAST{}
+	if err := l.expand(program, dir, stack, pending, result); err != nil {
+		return nil, err
+	}
+	l.pending = pending
+	return result, nil
+}
+
+// Commit marks the files imported by the last resolved program as loaded,
+// once its definitions were compiled. Until then, the next programs import
+// them again.
+func (l *Loader) Commit() {
+	for file := range l.pending {
+		l.loaded[file] = true
+	}
+	l.pending = nil
+}
+
+// expand appends to result the definitions of the imports of the program,
+// recursively, then the definitions of the program. stack holds the files
+// being loaded, the last one being the file of the program if any.
+func (l *Loader) expand(program *parser.ProgramAST, dir string, stack []string, pending map[string]bool, result *parser.ProgramAST) error {
+	for _, importAST := range program.Imports {
+		file, err := l.find(importAST.Path, dir)
+		if err != nil {
+			if len(stack) != 0 {
+				return fmt.Errorf("%s: %w", stack[len(stack)-1], err)
+			}
+			return err
+		}
+		for i, loading := range stack {
+			if loading == file {
+				return fmt.Errorf("Import cycle: %s", strings.Join(append(stack[i:], file), " -> "))
+			}
+		}
+		if l.loaded[file] || pending[file] {
+			continue
+		}
+		imported, err := l.parseFile(file)
+		if err != nil {
+			return err
+		}
+		if imported.HasTopLevelExpr() {
+			return fmt.Errorf("%s: an imported file cannot contain top level expressions", file)
+		}
+		for i := range imported.Globals {
+			imported.Globals[i].File = file
+		}
+		for i := range imported.Protos {
+			imported.Protos[i].File = file
+		}
+		for i := range imported.Funcs {
+			imported.Funcs[i].Prototype.File = file
+		}
+		if err := l.expand(imported, filepath.Dir(file), append(stack, file), pending, result); err != nil {
+			return err
+		}
+		pending[file] = true
+		l.tracer.Infof(trace.Parser, "Imported %s", file)
+	}
+	result.Globals = append(result.Globals, program.Globals...)
+	result.Protos = append(result.Protos, program.Protos...)
+	result.Funcs = append(result.Funcs, program.Funcs...)
+	return nil
+}
+
+// find returns the absolute path of an imported file.
+func (l *Loader) find(path string, importerDir string) (string, error) {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+	for _, dir := range append([]string{importerDir}, l.searchPath...) {
+		candidate, err := filepath.Abs(filepath.Join(dir, path))
+		if err != nil {
+			return "", err
+		}
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("Cannot find imported file %q", path)
+}
+
+func (l *Loader) parseFile(path string) (*parser.ProgramAST, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	program, err := yacc.BuildKaleidoASTWithTracer(string(data), l.tracer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return program, nil
+}
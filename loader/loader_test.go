@@ -0,0 +1,142 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func functionNames(t *testing.T, l *Loader, path string) []string {
+	program, err := l.LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, function := range program.Funcs {
+		names = append(names, function.Prototype.FunctionName)
+	}
+	return names
+}
+
+func TestLoadFileImports(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.kal":          `import "lib/geometry.kal"; import "square.kal"; def main() area(2)`,
+		"lib/geometry.kal":  `import "square.kal"; def area(r) 3 * square(r)`,
+		"lib/square.kal":    `def square(x) x * x`,
+		"shared/square.kal": `def square(x) x * x * 1`,
+	})
+	loader := New([]string{filepath.Join(dir, "shared")}, nil)
+	names := functionNames(t, loader, filepath.Join(dir, "main.kal"))
+	// square.kal is found next to geometry.kal, then in the search path for
+	// main.kal, so both are loaded.
+	if got := strings.Join(names, " "); got != "square area square main" {
+		t.Errorf("Unexpected definitions order: %s", got)
+	}
+	program, _ := New(nil, nil).LoadFile(filepath.Join(dir, "lib/geometry.kal"))
+	if file := program.Funcs[0].Prototype.File; file != filepath.Join(dir, "lib/square.kal") {
+		t.Errorf("Imported definitions should record their file, got %q", file)
+	}
+	if file := program.Funcs[1].Prototype.File; file != "" {
+		t.Errorf("Main file definitions should not record a file, got %q", file)
+	}
+}
+
+func TestLoadOnce(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.kal":   `import "lib.kal"; def a() f()`,
+		"b.kal":   `import "lib.kal"; import "a.kal"; def b() f()`,
+		"lib.kal": `def f() 1`,
+	})
+	loader := New(nil, nil)
+	if got := strings.Join(functionNames(t, loader, filepath.Join(dir, "b.kal")), " "); got != "f a b" {
+		t.Errorf("Unexpected definitions: %s", got)
+	}
+	loader.Commit()
+	if got := strings.Join(functionNames(t, loader, filepath.Join(dir, "a.kal")), " "); got != "a" {
+		t.Errorf("Already loaded imports should be skipped: %s", got)
+	}
+}
+
+func TestLoadAfterFailure(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.kal": `import "lib.kal"; def main() f()`,
+		"lib.kal":  `def f() 1`,
+	})
+	loader := New(nil, nil)
+	functionNames(t, loader, filepath.Join(dir, "main.kal"))
+	// Not committed, as if the program failed to compile: lib.kal must be
+	// imported again.
+	if got := strings.Join(functionNames(t, loader, filepath.Join(dir, "main.kal")), " "); got != "f main" {
+		t.Errorf("The import of a failed program should be loaded again: %s", got)
+	}
+	loader.Commit()
+	if got := strings.Join(functionNames(t, loader, filepath.Join(dir, "main.kal")), " "); got != "main" {
+		t.Errorf("Committed imports should be skipped: %s", got)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"cycle1.kal":  `import "cycle2.kal"; def f() 1`,
+		"cycle2.kal":  `import "cycle1.kal"; def g() 1`,
+		"missing.kal": `import "nowhere.kal";`,
+		"script.kal":  `import "toplevel.kal";`,
+		"toplevel.kal": `def f() 1
+f()`,
+	})
+	expectedErrors := map[string]string{
+		"cycle1.kal":  "Import cycle",
+		"missing.kal": "Cannot find imported file",
+		"script.kal":  "top level expressions",
+	}
+	for file, expected := range expectedErrors {
+		loader := New(nil, nil)
+		_, err := loader.LoadFile(filepath.Join(dir, file))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Loading %s should fail with %q, received: %v", file, expected, err)
+		}
+		if len(loader.loaded) != 0 {
+			t.Errorf("Loading %s failed, no file should be marked as loaded", file)
+		}
+	}
+}
@@ -27,67 +27,343 @@ SOFTWARE.
 package main
 
 import (
-	"bufio"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"strings"
 
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/kaleidort"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/loader"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
 	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser/yacc"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/passreport"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
 	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/visitor"
 )
 
 const EMPTY_STRING = ""
 
+// tracer is configured by the -v and -trace flags, nil keeps the compiler quiet.
+var tracer *trace.Tracer
+
+// optimization is configured by the -O and -passes flags.
+var optimization = visitor.DefaultOptimization
+
+// passReports records the optimization stages of the compiled functions
+// when -print-after-all or -pass-report is given.
+var passReports *passReportConfig
+
+type passReportConfig struct {
+	printAfterAll bool
+	htmlFile      string
+	reports       []passreport.FunctionReport
+}
+
+// compilerFlags are the options shared by the REPL, -file and build modes.
+type compilerFlags struct {
+	verbose       *bool
+	trace         *string
+	levels        map[string]*bool
+	passes        *string
+	printAfterAll *bool
+	passReport    *string
+	libraries     fileList
+	shared        fileList
+	importPaths   fileList
+	cacheDir      *string
+	workers       *int
+	maxDepth      *int
+	externs       *string
+}
+
+// fileList is a flag which can be repeated, each one giving a file.
+type fileList []string
+
+func (l *fileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *fileList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// bitcodeLibraries are given by the -L flags, and linked before compiling.
+var bitcodeLibraries []string
+
+// sharedLibraries are given by the -l flags, and loaded before compiling.
+var sharedLibraries []string
+
+// compilationCache is enabled by the -cache flag.
+var compilationCache *visitor.CompilationCache
+
+// workers is the number of goroutines compiling functions, set by -j.
+var workers = 1
+
+// recursionLimit is the depth of calls stopping an evaluation, set by
+// -max-depth.
+var recursionLimit = visitor.DefaultRecursionLimit
+
+// externPolicy restricts the external functions to the ones given by
+// -externs, nil allowing all of them.
+var externPolicy visitor.ExternPolicy
+
+// importSearchPath is given by the -I flags, where imported files are looked
+// up when not found next to the importing file.
+var importSearchPath []string
+
+// parseExterns returns the policy allowing the listed external functions,
+// math standing for visitor.MathExterns and runtime for all the functions of
+// the runtime library.
+func parseExterns(list string) visitor.ExternPolicy {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "math":
+			names = append(names, visitor.MathExterns...)
+		case "runtime":
+			for _, function := range kaleidort.Functions() {
+				names = append(names, function.Name)
+			}
+		default:
+			names = append(names, name)
+		}
+	}
+	return visitor.AllowExterns(names...)
+}
+
+func registerCompilerFlags(flags *flag.FlagSet) *compilerFlags {
+	compiler := &compilerFlags{levels: map[string]*bool{}}
+	compiler.verbose = flags.Bool("v", false, "Trace the main steps of the compiler")
+	compiler.trace = flags.String("trace", EMPTY_STRING, "Comma separated categories to trace in detail: lexer, parser, codegen, passes, jit or all")
+	for _, level := range []string{"O0", "O1", "O2", "O3", "Os", "Oz"} {
+		compiler.levels[level] = flags.Bool(level, false, "Optimization level, based on the LLVM pass manager builder")
+	}
+	compiler.passes = flags.String("passes", EMPTY_STRING, "Comma separated passes to run instead of an optimization level, for instance instcombine,gvn,inline")
+	compiler.printAfterAll = flags.Bool("print-after-all", false, "Run the passes one at a time and print the IR diff after each one")
+	compiler.passReport = flags.String("pass-report", EMPTY_STRING, "HTML file where the IR after each pass is reported")
+	flags.Var(&compiler.libraries, "L", "Bitcode library to link with the program, can be repeated")
+	flags.Var(&compiler.shared, "l", "Shared library whose functions can be declared as externs, such as libm.so.6, can be repeated")
+	flags.Var(&compiler.importPaths, "I", "Directory where imported files are searched, can be repeated")
+	compiler.workers = flags.Int("j", 1, "Number of goroutines compiling the functions of a program in parallel")
+	compiler.maxDepth = flags.Int("max-depth", visitor.DefaultRecursionLimit, "Depth of calls stopping an evaluation instead of exhausting the stack, 0 for no limit")
+	compiler.externs = flags.String("externs", EMPTY_STRING, "Comma separated external functions the programs can declare, math for the C math functions, runtime for the runtime library, all by default")
+	compiler.cacheDir = flags.String("cache", EMPTY_STRING, "Directory where the compiled functions are cached between runs")
+	return compiler
+}
+
+// apply configures the compiler from the flags. The returned function
+// must be called once the compilation is done.
+func (c *compilerFlags) apply() (func(), error) {
+	if err := setupTracer(*c.verbose, *c.trace); err != nil {
+		return nil, err
+	}
+	if err := setupOptimization(c.levels, *c.passes); err != nil {
+		return nil, err
+	}
+	bitcodeLibraries = c.libraries
+	sharedLibraries = c.shared
+	importSearchPath = c.importPaths
+	workers = *c.workers
+	recursionLimit = *c.maxDepth
+	if *c.externs != EMPTY_STRING {
+		externPolicy = parseExterns(*c.externs)
+	}
+	if *c.cacheDir != EMPTY_STRING {
+		compilationCache = visitor.NewCompilationCache(*c.cacheDir)
+	}
+	if *c.printAfterAll || *c.passReport != EMPTY_STRING {
+		passReports = &passReportConfig{printAfterAll: *c.printAfterAll, htmlFile: *c.passReport}
+		return passReports.writeHTML, nil
+	}
+	return func() {}, nil
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "build" {
+		os.Exit(runBuild(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "runtime" {
+		os.Exit(runRuntime(os.Args[2:]))
+	}
 	filePtr := flag.String("file", EMPTY_STRING, "File container Kaleidoscope program")
+	sessionPtr := flag.String("session", EMPTY_STRING, "REPL session file, restored on startup and saved on exit")
+	transcriptPtr := flag.String("transcript", defaultTranscriptPath(), "File where the REPL inputs and outputs are logged, empty to disable")
+	compiler := registerCompilerFlags(flag.CommandLine)
 	flag.Parse()
+	done, err := compiler.apply()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer done()
 	if *filePtr == EMPTY_STRING {
-		startREPL()
+		startREPL(replConfig{sessionFile: *sessionPtr, transcriptFile: *transcriptPtr})
 		return
 	}
 	processFile(*filePtr)
 
 }
 
-func processFile(filename string) {
-	data, err := ioutil.ReadFile(filename)
+func setupTracer(verbose bool, categoryList string) error {
+	categories, err := trace.ParseCategories(categoryList)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	kaleidoVisitor := visitor.NewVisitorKaleido()
-	if err := consumeAndProcess(string(data), &kaleidoVisitor); err != nil {
-		fmt.Println(err)
+	if !verbose && len(categories) == 0 {
+		return nil
 	}
+	tracer = trace.New(os.Stderr)
+	if verbose {
+		tracer.Enable(trace.LevelInfo, trace.AllCategories()...)
+	}
+	tracer.Enable(trace.LevelDebug, categories...)
+	return nil
 }
 
-func startREPL() {
-	reader := bufio.NewReader(os.Stdin)
-	kaleidoVisitor := visitor.NewVisitorKaleido()
-	for {
-		fmt.Print("kaleido> ")
-		input, _ := reader.ReadString('\n')
-		if err := consumeAndProcess(input, &kaleidoVisitor); err != nil {
-			fmt.Println(err)
+func setupOptimization(levels map[string]*bool, passList string) error {
+	selected := 0
+	for level, enabled := range levels {
+		if !*enabled {
+			continue
+		}
+		selected++
+		switch level {
+		case "Os":
+			optimization = visitor.OptimizationConfig{Level: 2, SizeLevel: 1}
+		case "Oz":
+			optimization = visitor.OptimizationConfig{Level: 2, SizeLevel: 2}
+		default:
+			optimization = visitor.OptimizationConfig{Level: int(level[1] - '0')}
+		}
+	}
+	if passList != EMPTY_STRING {
+		selected++
+		passes, err := visitor.ParsePasses(passList)
+		if err != nil {
+			return err
 		}
+		optimization = visitor.OptimizationConfig{Passes: passes}
+	}
+	if selected > 1 {
+		return errors.New("Only one optimization level or pass list can be given")
+	}
+	return nil
+}
+
+func (c *passReportConfig) record(function string, stages []visitor.PassStage) {
+	report := passreport.FunctionReport{Function: function}
+	for _, stage := range stages {
+		report.Stages = append(report.Stages, passreport.Stage(stage))
+	}
+	if c.printAfterAll {
+		passreport.WriteText(os.Stderr, report)
+	}
+	if c.htmlFile != EMPTY_STRING {
+		c.reports = append(c.reports, report)
 	}
 }
 
-func consumeAndProcess(input string, kaleidoVisitor *visitor.VisitorKaleido) error {
-	kaleidoAST, err := yacc.BuildKaleidoAST(input)
+func (c *passReportConfig) writeHTML() {
+	if c.htmlFile == EMPTY_STRING {
+		return
+	}
+	file, err := os.Create(c.htmlFile)
 	if err != nil {
-		return err
+		fmt.Fprintln(os.Stderr, "Cannot write pass report:", err)
+		return
+	}
+	defer file.Close()
+	if err := passreport.WriteHTML(file, c.reports); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot write pass report:", err)
 	}
-	err = kaleidoVisitor.FeedAST(kaleidoAST)
+}
+
+func newVisitor() (visitor.VisitorKaleido, error) {
+	return configureVisitor(visitor.NewVisitorKaleido())
+}
+
+// configureVisitor applies the command line options to a visitor, loads the
+// shared libraries and links the bitcode libraries. The visitor is closed on
+// error.
+func configureVisitor(kaleidoVisitor visitor.VisitorKaleido) (visitor.VisitorKaleido, error) {
+	kaleidoVisitor.SetTracer(tracer)
+	kaleidoVisitor.SetOptimization(optimization)
+	kaleidoVisitor.SetCache(compilationCache)
+	kaleidoVisitor.SetWorkers(workers)
+	kaleidoVisitor.SetRecursionLimit(recursionLimit)
+	kaleidoVisitor.SetExternPolicy(externPolicy)
+	if passReports != nil {
+		kaleidoVisitor.SetPassObserver(passReports.record)
+	}
+	for _, library := range sharedLibraries {
+		if err := kaleidoVisitor.LoadLibrary(library); err != nil {
+			kaleidoVisitor.Close()
+			return kaleidoVisitor, err
+		}
+	}
+	for _, library := range bitcodeLibraries {
+		if err := kaleidoVisitor.LinkBitcodeLibrary(library); err != nil {
+			kaleidoVisitor.Close()
+			return kaleidoVisitor, fmt.Errorf("Cannot link %s: %w", library, err)
+		}
+	}
+	return kaleidoVisitor, nil
+}
+
+func newLoader() *loader.Loader {
+	return loader.New(importSearchPath, tracer)
+}
+
+func parse(input string) (*parser.ProgramAST, error) {
+	return yacc.BuildKaleidoASTWithTracer(input, tracer)
+}
+
+func processFile(filename string) {
+	kaleidoAST, err := newLoader().LoadFile(filename)
 	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	kaleidoVisitor, err := newVisitor()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer kaleidoVisitor.Close()
+	if err := processAST(kaleidoAST, &kaleidoVisitor, os.Stdout); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func processAST(kaleidoAST *parser.ProgramAST, kaleidoVisitor *visitor.VisitorKaleido, output io.Writer) error {
+	if err := feedAST(kaleidoAST, kaleidoVisitor, output); err != nil {
 		return err
 	}
-	println(kaleidoVisitor.GenerateLastModuleIR())
+	return evaluateAST(kaleidoAST, kaleidoVisitor, output)
+}
+
+// feedAST compiles a program, then prints the warnings of the compilation.
+func feedAST(kaleidoAST *parser.ProgramAST, kaleidoVisitor *visitor.VisitorKaleido, output io.Writer) error {
+	err := kaleidoVisitor.FeedAST(kaleidoAST)
+	for _, warning := range kaleidoVisitor.FlushWarnings() {
+		fmt.Fprintln(output, "Warning:", warning)
+	}
+	return err
+}
+
+// evaluateAST evaluates the top level expressions of a compiled program.
+func evaluateAST(kaleidoAST *parser.ProgramAST, kaleidoVisitor *visitor.VisitorKaleido, output io.Writer) error {
+	if !kaleidoAST.HasTopLevelExpr() {
+		return nil
+	}
 	res, err := kaleidoVisitor.EvalutateMain()
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Main evaluated to: %v\n", res)
+	fmt.Fprintf(output, "Main evaluated to: %v\n", res)
 	return nil
 }
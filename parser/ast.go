@@ -24,13 +24,84 @@ SOFTWARE.
 
 package parser
 
+import "fmt"
+
+// MainFunctionName is the name of the function wrapping a top level expression.
+const MainFunctionName = "__main__"
+
+// Type is the static type of a value, or of an argument or result of an
+// extern using the C types.
+type Type string
+
+const (
+	// TypeUnspecified is the type of an argument or a result without
+	// annotation: a double for an argument, inferred for a result.
+	TypeUnspecified Type = ""
+	TypeDouble      Type = "double"
+	TypeInt         Type = "int"
+	TypeBool        Type = "bool"
+	// TypePtr is an opaque pointer, such as a string.
+	TypePtr Type = "ptr"
+)
+
+// C types, only usable by externs.
+const (
+	TypeI8   Type = "i8"
+	TypeI16  Type = "i16"
+	TypeI32  Type = "i32"
+	TypeI64  Type = "i64"
+	TypeF32  Type = "f32"
+	TypeF64  Type = "f64"
+	TypeVoid Type = "void"
+)
+
+// IsType tells if a name is the name of the type of a value.
+func IsType(name string) bool {
+	switch Type(name) {
+	case TypeDouble, TypeInt, TypeBool, TypePtr:
+		return true
+	}
+	return false
+}
+
+// IsCType tells if a type is a C type, a pointer such as i8* included.
+func (t Type) IsCType() bool {
+	switch t {
+	case TypeI8, TypeI16, TypeI32, TypeI64, TypeF32, TypeF64, TypeVoid:
+		return true
+	}
+	return t.IsPointer()
+}
+
+// IsPointer tells if a type is a C pointer, such as i8*.
+func (t Type) IsPointer() bool {
+	return len(t) > 1 && t[len(t)-1] == '*'
+}
+
+// Pos is a position in the source, the zero value being unknown.
+type Pos struct {
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// IsValid tells if the position is known.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
 type Visitor interface {
 	VisitNumberExprAST(*NumberExprAST) interface{}
+	VisitStringExprAST(*StringExprAST) interface{}
 	VisitBinaryExprAST(*BinaryExprAST) interface{}
 	VisitVariableExprAST(*VariableExprAST) interface{}
 	VisitCallExprAST(*CallExprAST) interface{}
 	VisitPrototypeAST(*PrototypeAST) interface{}
 	VisitFunctionAST(*FunctionAST) interface{}
+	VisitGlobalAST(*GlobalAST) interface{}
 }
 
 type Visitable interface {
@@ -38,8 +109,10 @@ type Visitable interface {
 }
 
 type ProgramAST struct {
-	Funcs  []FunctionAST
-	Protos []PrototypeAST
+	Funcs   []FunctionAST
+	Protos  []PrototypeAST
+	Imports []ImportAST
+	Globals []GlobalAST
 }
 
 func (p *ProgramAST) Accept(visitor Visitor) interface{} {
@@ -53,6 +126,9 @@ func (p *ProgramAST) Accept(visitor Visitor) interface{} {
 	// https://github.com/golang/go/issues/16520
 	// https://github.com/golang/go/issues/20725
 	// https://github.com/golang/go/issues/20733
+	for i := range p.Globals {
+		p.Globals[i].Accept(visitor)
+	}
 	for i := range p.Protos {
 		p.Protos[i].Accept(visitor)
 	}
@@ -62,20 +138,45 @@ func (p *ProgramAST) Accept(visitor Visitor) interface{} {
 	return nil
 }
 
+// HasTopLevelExpr tells if the program contains a top level expression,
+// to be evaluated through the main function.
+func (p *ProgramAST) HasTopLevelExpr() bool {
+	for i := range p.Funcs {
+		if p.Funcs[i].Prototype.FunctionName == MainFunctionName {
+			return true
+		}
+	}
+	return false
+}
+
 type ExprAST interface {
 	Visitable
 }
 
-type NumberExprAST string
+// NumberExprAST is a number literal, as written in the source.
+type NumberExprAST struct {
+	Value string
+	Pos   Pos
+}
 
 func (n NumberExprAST) Accept(visitor Visitor) interface{} {
 	return visitor.VisitNumberExprAST(&n)
 }
 
+// StringExprAST is a string literal, its value being a pointer to its
+// characters followed by a null character.
+type StringExprAST string
+
+func (s StringExprAST) Accept(visitor Visitor) interface{} {
+	return visitor.VisitStringExprAST(&s)
+}
+
 type BinaryExprAST struct {
 	LHS ExprAST
 	RHS ExprAST
 	Op  rune
+	// Pos is the position of the operator.
+	Pos Pos
 }
 
 func (b *BinaryExprAST) Accept(visitor Visitor) interface{} {
@@ -91,6 +192,7 @@ func (v VariableExprAST) Accept(visitor Visitor) interface{} {
 type CallExprAST struct {
 	FunctionName string
 	Args         []ExprAST
+	Pos          Pos
 }
 
 func (c *CallExprAST) Accept(visitor Visitor) interface{} {
@@ -100,6 +202,28 @@ func (c *CallExprAST) Accept(visitor Visitor) interface{} {
 type PrototypeAST struct {
 	FunctionName string
 	Args         []string
+	// ArgTypes are the annotated types of the arguments, nil when none is
+	// annotated.
+	ArgTypes []Type
+	// ReturnType is the annotated type of the result.
+	ReturnType Type
+	// Variadic externs take more arguments than declared, as printf.
+	Variadic bool
+	// Library is the shared library an extern is loaded from, as in
+	// extern "libm.so.6" cbrt(x), empty if not given.
+	Library string
+	// File is the imported file declaring the function, empty for the
+	// main program.
+	File string
+	Pos  Pos
+}
+
+// ArgType returns the type of an argument, a double unless annotated.
+func (p *PrototypeAST) ArgType(i int) Type {
+	if i < len(p.ArgTypes) && p.ArgTypes[i] != TypeUnspecified {
+		return p.ArgTypes[i]
+	}
+	return TypeDouble
 }
 
 func (p *PrototypeAST) Accept(visitor Visitor) interface{} {
@@ -109,12 +233,36 @@ func (p *PrototypeAST) Accept(visitor Visitor) interface{} {
 type FunctionAST struct {
 	Prototype PrototypeAST
 	Body      ExprAST
+	// Private functions are only visible from their own file.
+	Private bool
 }
 
 func (f *FunctionAST) Accept(visitor Visitor) interface{} {
 	return visitor.VisitFunctionAST(f)
 }
 
+// GlobalAST declares a variable visible from every function. A constant is
+// folded into the code reading it, a global is stored in memory and may be
+// changed later.
+type GlobalAST struct {
+	Name  string
+	Value ExprAST
+	Const bool
+	// File is the imported file declaring the variable, empty for the main
+	// program.
+	File string
+}
+
+func (g *GlobalAST) Accept(visitor Visitor) interface{} {
+	return visitor.VisitGlobalAST(g)
+}
+
+// ImportAST is resolved by the loader, which replaces it with the
+// definitions of the imported file.
+type ImportAST struct {
+	Path string
+}
+
 type ArgList []string
 
 type ExprList []ExprAST
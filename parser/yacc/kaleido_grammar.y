@@ -26,43 +26,74 @@ SOFTWARE.
 package yacc
 
 import(
-    "log"
     "errors"
+    "fmt"
     "unicode/utf8"
     "github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
     "github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/lexer"
+    "github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
 )
 
+// parserToken is a token with its position.
+type parserToken struct {
+    lexer.KaleidoTokenContext
+    pos parser.Pos
+}
+
+// protoArgs are the arguments of a prototype with their types, typed being
+// true when at least one is annotated.
+type protoArgs struct {
+    names parser.ArgList
+    types []parser.Type
+    typed bool
+    variadic bool
+}
+
+func (a protoArgs) append(arg protoArgs) protoArgs {
+    return protoArgs{names: append(a.names, arg.names...), types: append(a.types, arg.types...), typed: a.typed || arg.typed}
+}
+
 %}
 
 %union{
-    token lexer.KaleidoTokenContext
+    token parserToken
 	proto parser.PrototypeAST
     function parser.FunctionAST
 	expr  parser.ExprAST
-    argList parser.ArgList
+    protoArgs protoArgs
+    typeName parser.Type
     exprList parser.ExprList
     program parser.ProgramAST
     number parser.NumberExprAST
     variable parser.VariableExprAST
+    importAST parser.ImportAST
+    global parser.GlobalAST
 }
 
 %token DEF
 %token EXTERN
+%token IMPORT
+%token PRIVATE
+%token GLOBAL
+%token CONST
+%token<token> STRING
 %token<token> NUMBER
 
-%left '<'
-%left '+' '-'
-%left '*'
+%left<token> '<'
+%left<token> '+' '-'
+%left<token> '*'
 
 %left<token> IDENTIFIER
 %left '('
 
 %type<expr> Expr FuncExpr
-%type<argList> ProtoArgList
+%type<protoArgs> ProtoArgs ProtoArgItems ProtoArg
+%type<typeName> ReturnType TypeName
 %type<exprList> ExprList ExprListContinuation
 %type<proto> Prototype Ext
 %type<function> Def TopLevelExpr
+%type<importAST> Import
+%type<global> Global
 %type<program> TopLevel Program
 
 
@@ -79,6 +110,22 @@ TopLevel: TopLevel Def Delimiter
         $1.Funcs = append($1.Funcs, $2)
         $$ = $1
     };
+TopLevel: TopLevel PRIVATE Def Delimiter
+    {
+        $3.Private = true
+        $1.Funcs = append($1.Funcs, $3)
+        $$ = $1
+    };
+TopLevel: TopLevel Import Delimiter
+    {
+        $1.Imports = append($1.Imports, $2)
+        $$ = $1
+    };
+TopLevel: TopLevel Global Delimiter
+    {
+        $1.Globals = append($1.Globals, $2)
+        $$ = $1
+    };
 TopLevel: TopLevel Ext Delimiter
     {
         $1.Protos = append($1.Protos, $2)
@@ -104,31 +151,50 @@ Ext: EXTERN Prototype ';'
     {
         $$ = $2
     };
+Ext: EXTERN STRING Prototype ';'
+    {
+        $3.Library = $2.Value
+        $$ = $3
+    };
+Import: IMPORT STRING
+    {
+        $$ = parser.ImportAST{Path: $2.Value}
+    };
+Global: GLOBAL IDENTIFIER '=' Expr
+    {
+        $$ = parser.GlobalAST{Name: $2.Value, Value: $4}
+    };
+Global: CONST IDENTIFIER '=' Expr
+    {
+        $$ = parser.GlobalAST{Name: $2.Value, Value: $4, Const: true}
+    };
 TopLevelExpr: Expr
     {
-        $$ = parser.FunctionAST{Prototype: parser.PrototypeAST{FunctionName: "__main__", Args: []string{}},Body: $1}
+        $$ = parser.FunctionAST{Prototype: parser.PrototypeAST{FunctionName: parser.MainFunctionName, Args: []string{}},Body: $1}
     };
 
 Expr: IDENTIFIER
     { $$ = parser.VariableExprAST($1.Value) };
 Expr: NUMBER
-    { $$ = parser.NumberExprAST($1.Value) };
+    { $$ = parser.NumberExprAST{Value: $1.Value, Pos: $1.pos} };
+Expr: STRING
+    { $$ = parser.StringExprAST($1.Value) };
 Expr: FuncExpr ;
 Expr: '(' Expr ')'
     { $$ = $2 };
 Expr:  Expr '+' Expr
-    { $$ = &parser.BinaryExprAST{LHS: $1, RHS: $3, Op: '+'} };
+    { $$ = &parser.BinaryExprAST{LHS: $1, RHS: $3, Op: '+', Pos: $2.pos} };
 Expr:  Expr '-' Expr
-    { $$ = &parser.BinaryExprAST{LHS: $1, RHS: $3, Op: '-'} };
+    { $$ = &parser.BinaryExprAST{LHS: $1, RHS: $3, Op: '-', Pos: $2.pos} };
 Expr:  Expr '<' Expr
-    { $$ = &parser.BinaryExprAST{LHS: $1, RHS: $3, Op: '<'} };
+    { $$ = &parser.BinaryExprAST{LHS: $1, RHS: $3, Op: '<', Pos: $2.pos} };
 Expr:  Expr '*' Expr
-    { $$ = &parser.BinaryExprAST{LHS: $1, RHS: $3, Op: '*'} };
+    { $$ = &parser.BinaryExprAST{LHS: $1, RHS: $3, Op: '*', Pos: $2.pos} };
 
 FuncExpr: IDENTIFIER '(' ExprList ')'
     {
-        log.Println("Parsed rule: FuncExpr")
-        $$ = &parser.CallExprAST{FunctionName: $1.Value, Args: $3}
+        yylex.(*parserContext).tracer.Debugf(trace.Parser, "Parsed rule: FuncExpr")
+        $$ = &parser.CallExprAST{FunctionName: $1.Value, Args: $3, Pos: $1.pos}
     };
 ExprList: ExprListContinuation ;
 ExprList:  /* Empty */
@@ -138,28 +204,68 @@ ExprListContinuation: ExprListContinuation ',' Expr
 ExprListContinuation: Expr
     { $$ = []parser.ExprAST { $1 } };
 
-Prototype: IDENTIFIER '(' ProtoArgList ')'
+Prototype: IDENTIFIER '(' ProtoArgs ')' ReturnType
     {
-        $$ = parser.PrototypeAST{FunctionName: $1.Value, Args: $3}
+        $$ = parser.PrototypeAST{FunctionName: $1.Value, Args: $3.names, ReturnType: $5, Variadic: $3.variadic, Pos: $1.pos}
+        if $3.typed {
+            $$.ArgTypes = $3.types
+        }
     };
-ProtoArgList: ProtoArgList IDENTIFIER
-    { $$ = append($1, $2.Value) };
-ProtoArgList:  /* Empty */
-    { $$ = []string {  } } ; 
+ProtoArgs: ProtoArgItems ;
+ProtoArgs: ProtoArgItems Ellipsis
+    {
+        $1.variadic = true
+        $$ = $1
+    };
+ProtoArgs: ProtoArgItems ',' Ellipsis
+    {
+        $1.variadic = true
+        $$ = $1
+    };
+ProtoArgs: /* Empty */
+    { $$ = protoArgs{names: []string{}} } ;
+ProtoArgItems: ProtoArg ;
+ProtoArgItems: ProtoArgItems ProtoArg
+    { $$ = $1.append($2) };
+ProtoArgItems: ProtoArgItems ',' ProtoArg
+    { $$ = $1.append($3) };
+ProtoArg: IDENTIFIER
+    { $$ = protoArgs{names: []string{$1.Value}, types: []parser.Type{parser.TypeUnspecified}} };
+ProtoArg: IDENTIFIER ':' TypeName
+    { $$ = protoArgs{names: []string{$1.Value}, types: []parser.Type{$3}, typed: true} };
+Ellipsis: '.' '.' '.' ;
+ReturnType: /* Empty */
+    { $$ = parser.TypeUnspecified } ;
+ReturnType: ':' TypeName
+    { $$ = $2 };
+TypeName: IDENTIFIER
+    { $$ = parser.Type($1.Value) };
+TypeName: TypeName '*'
+    { $$ = $1 + "*" };
 
 %%
 
 const EOF = 0
 
+// ErrIncompleteInput is returned when the input ends before a valid program,
+// for instance with unbalanced parentheses: more input may complete it.
+var ErrIncompleteInput = errors.New("incomplete input")
+
 type parserContext struct {
     lexer.KaleidoLexer
     result * parser.ProgramAST
     err error
+    lastToken lexer.KaleidoToken
+    lexError string
+    tracer *trace.Tracer
 }
 
 func (s *parserContext) Lex(lval *yySymType) int {
     tokenContext := s.NextToken()
-    lval.token = *tokenContext
+    line, column := s.TokenPosition()
+    lval.token = parserToken{KaleidoTokenContext: *tokenContext, pos: parser.Pos{Line: line, Column: column}}
+    s.lastToken = tokenContext.Token
+    s.tracer.Debugf(trace.Lexer, "Token %v %q", tokenContext.Token, tokenContext.Value)
     switch tokenContext.Token {
     case lexer.KTokenEOF:
         return EOF
@@ -171,6 +277,21 @@ func (s *parserContext) Lex(lval *yySymType) int {
         return IDENTIFIER
     case lexer.KTokenNumber:
         return NUMBER
+    case lexer.KTokenImport:
+        return IMPORT
+    case lexer.KTokenPrivate:
+        return PRIVATE
+    case lexer.KTokenString:
+        return STRING
+    case lexer.KTokenGlobal:
+        return GLOBAL
+    case lexer.KTokenConst:
+        return CONST
+    case lexer.KTokenError:
+        // No rule accepts the replacement character, so the parser reports
+        // the error.
+        s.lexError = tokenContext.Value
+        return utf8.RuneError
 	default:
 		val, _ := utf8.DecodeRuneInString(tokenContext.Value)
 		return int(val)
@@ -179,14 +300,35 @@ func (s *parserContext) Lex(lval *yySymType) int {
 
 func (s *parserContext) Error(e string) {
     s.result = nil
+    if s.lastToken == lexer.KTokenError {
+        // More input may complete an unterminated string.
+        if s.lexError == lexer.UnterminatedString {
+            s.err = fmt.Errorf("%w: %s", ErrIncompleteInput, s.lexError)
+        } else {
+            s.err = errors.New(s.lexError)
+        }
+        return
+    }
+    if s.lastToken == lexer.KTokenEOF {
+        s.err = fmt.Errorf("%w: %s", ErrIncompleteInput, e)
+        return
+    }
     s.err = errors.New(e)
 }
 
 func BuildKaleidoAST(buffer string) (*parser.ProgramAST, error) {
-    context := &parserContext{KaleidoLexer: lexer.NewKaleidoLexer(buffer)}
+    return BuildKaleidoASTWithTracer(buffer, nil)
+}
+
+// BuildKaleidoASTWithTracer parses the buffer, tracing the lexer and parser
+// categories with the given tracer, which may be nil.
+func BuildKaleidoASTWithTracer(buffer string, tracer *trace.Tracer) (*parser.ProgramAST, error) {
+    context := &parserContext{KaleidoLexer: lexer.NewKaleidoLexer(buffer), tracer: tracer}
     yyParse(context)
     if context.result == nil {
+        tracer.Infof(trace.Parser, "Parse error: %v", context.err)
         return nil, context.err
     }
+    tracer.Infof(trace.Parser, "Parsed %d functions and %d externs", len(context.result.Funcs), len(context.result.Protos))
     return context.result, nil
 }
@@ -29,29 +29,57 @@ import __yyfmt__ "fmt"
 
 import (
 	"errors"
+	"fmt"
 	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/lexer"
 	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
-	"log"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
 	"unicode/utf8"
 )
 
+// parserToken is a token with its position.
+type parserToken struct {
+	lexer.KaleidoTokenContext
+	pos parser.Pos
+}
+
+// protoArgs are the arguments of a prototype with their types, typed being
+// true when at least one is annotated.
+type protoArgs struct {
+	names    parser.ArgList
+	types    []parser.Type
+	typed    bool
+	variadic bool
+}
+
+func (a protoArgs) append(arg protoArgs) protoArgs {
+	return protoArgs{names: append(a.names, arg.names...), types: append(a.types, arg.types...), typed: a.typed || arg.typed}
+}
+
 type yySymType struct {
-	yys      int
-	token    lexer.KaleidoTokenContext
-	proto    parser.PrototypeAST
-	function parser.FunctionAST
-	expr     parser.ExprAST
-	argList  parser.ArgList
-	exprList parser.ExprList
-	program  parser.ProgramAST
-	number   parser.NumberExprAST
-	variable parser.VariableExprAST
+	yys       int
+	token     parserToken
+	proto     parser.PrototypeAST
+	function  parser.FunctionAST
+	expr      parser.ExprAST
+	protoArgs protoArgs
+	typeName  parser.Type
+	exprList  parser.ExprList
+	program   parser.ProgramAST
+	number    parser.NumberExprAST
+	variable  parser.VariableExprAST
+	importAST parser.ImportAST
+	global    parser.GlobalAST
 }
 
 const DEF = 57346
 const EXTERN = 57347
-const NUMBER = 57348
-const IDENTIFIER = 57349
+const IMPORT = 57348
+const PRIVATE = 57349
+const GLOBAL = 57350
+const CONST = 57351
+const STRING = 57352
+const NUMBER = 57353
+const IDENTIFIER = 57354
 
 var yyToknames = [...]string{
 	"$end",
@@ -59,6 +87,11 @@ var yyToknames = [...]string{
 	"$unk",
 	"DEF",
 	"EXTERN",
+	"IMPORT",
+	"PRIVATE",
+	"GLOBAL",
+	"CONST",
+	"STRING",
 	"NUMBER",
 	"'<'",
 	"'+'",
@@ -67,8 +100,11 @@ var yyToknames = [...]string{
 	"IDENTIFIER",
 	"'('",
 	"';'",
+	"'='",
 	"')'",
 	"','",
+	"':'",
+	"'.'",
 }
 
 var yyStatenames = [...]string{}
@@ -79,15 +115,25 @@ const yyInitialStackSize = 16
 
 const EOF = 0
 
+// ErrIncompleteInput is returned when the input ends before a valid program,
+// for instance with unbalanced parentheses: more input may complete it.
+var ErrIncompleteInput = errors.New("incomplete input")
+
 type parserContext struct {
 	lexer.KaleidoLexer
-	result *parser.ProgramAST
-	err    error
+	result    *parser.ProgramAST
+	err       error
+	lastToken lexer.KaleidoToken
+	lexError  string
+	tracer    *trace.Tracer
 }
 
 func (s *parserContext) Lex(lval *yySymType) int {
 	tokenContext := s.NextToken()
-	lval.token = *tokenContext
+	line, column := s.TokenPosition()
+	lval.token = parserToken{KaleidoTokenContext: *tokenContext, pos: parser.Pos{Line: line, Column: column}}
+	s.lastToken = tokenContext.Token
+	s.tracer.Debugf(trace.Lexer, "Token %v %q", tokenContext.Token, tokenContext.Value)
 	switch tokenContext.Token {
 	case lexer.KTokenEOF:
 		return EOF
@@ -99,6 +145,21 @@ func (s *parserContext) Lex(lval *yySymType) int {
 		return IDENTIFIER
 	case lexer.KTokenNumber:
 		return NUMBER
+	case lexer.KTokenImport:
+		return IMPORT
+	case lexer.KTokenPrivate:
+		return PRIVATE
+	case lexer.KTokenString:
+		return STRING
+	case lexer.KTokenGlobal:
+		return GLOBAL
+	case lexer.KTokenConst:
+		return CONST
+	case lexer.KTokenError:
+		// No rule accepts the replacement character, so the parser reports
+		// the error.
+		s.lexError = tokenContext.Value
+		return utf8.RuneError
 	default:
 		val, _ := utf8.DecodeRuneInString(tokenContext.Value)
 		return int(val)
@@ -107,15 +168,36 @@ func (s *parserContext) Lex(lval *yySymType) int {
 
 func (s *parserContext) Error(e string) {
 	s.result = nil
+	if s.lastToken == lexer.KTokenError {
+		// More input may complete an unterminated string.
+		if s.lexError == lexer.UnterminatedString {
+			s.err = fmt.Errorf("%w: %s", ErrIncompleteInput, s.lexError)
+		} else {
+			s.err = errors.New(s.lexError)
+		}
+		return
+	}
+	if s.lastToken == lexer.KTokenEOF {
+		s.err = fmt.Errorf("%w: %s", ErrIncompleteInput, e)
+		return
+	}
 	s.err = errors.New(e)
 }
 
 func BuildKaleidoAST(buffer string) (*parser.ProgramAST, error) {
-	context := &parserContext{KaleidoLexer: lexer.NewKaleidoLexer(buffer)}
+	return BuildKaleidoASTWithTracer(buffer, nil)
+}
+
+// BuildKaleidoASTWithTracer parses the buffer, tracing the lexer and parser
+// categories with the given tracer, which may be nil.
+func BuildKaleidoASTWithTracer(buffer string, tracer *trace.Tracer) (*parser.ProgramAST, error) {
+	context := &parserContext{KaleidoLexer: lexer.NewKaleidoLexer(buffer), tracer: tracer}
 	yyParse(context)
 	if context.result == nil {
+		tracer.Infof(trace.Parser, "Parse error: %v", context.err)
 		return nil, context.err
 	}
+	tracer.Infof(trace.Parser, "Parsed %d functions and %d externs", len(context.result.Funcs), len(context.result.Protos))
 	return context.result, nil
 }
 
@@ -127,56 +209,76 @@ var yyExca = [...]int{
 
 const yyPrivate = 57344
 
-const yyLast = 53
+const yyLast = 97
 
 var yyAct = [...]int{
-	8, 22, 20, 21, 23, 39, 38, 27, 36, 6,
-	7, 10, 41, 25, 10, 40, 9, 12, 26, 9,
-	12, 29, 30, 31, 32, 35, 22, 20, 21, 23,
-	28, 14, 20, 21, 23, 24, 18, 23, 17, 13,
-	42, 1, 2, 5, 15, 16, 19, 3, 4, 34,
-	33, 37, 11,
+	76, 14, 57, 65, 20, 79, 75, 72, 27, 58,
+	23, 24, 25, 26, 66, 63, 68, 58, 69, 17,
+	16, 39, 32, 64, 68, 15, 19, 40, 62, 41,
+	44, 43, 36, 34, 35, 37, 47, 48, 49, 50,
+	53, 61, 46, 45, 21, 59, 60, 42, 9, 13,
+	10, 4, 11, 12, 17, 16, 34, 35, 37, 67,
+	15, 19, 38, 77, 58, 70, 33, 28, 31, 74,
+	73, 30, 28, 78, 36, 34, 35, 37, 80, 37,
+	29, 3, 54, 9, 1, 2, 22, 6, 5, 8,
+	7, 52, 51, 71, 56, 55, 18,
 }
 
 var yyPact = [...]int{
-	-1000, -1000, 5, 18, 18, 18, 25, 25, 19, 23,
-	-1000, -1000, 8, -1000, -1000, -1000, -1000, 8, -5, 17,
-	8, 8, 8, 8, 8, -6, 19, -1000, -1000, 27,
-	27, 24, -1000, -8, -10, 19, -1000, 1, -1000, 8,
-	-1000, -1000, 19,
+	-1000, -1000, 44, 26, 79, 26, 26, 26, 26, 51,
+	70, 55, 52, 56, 20, 45, -1000, -1000, -1000, 9,
+	-1000, -1000, 26, -1000, -1000, -1000, -1000, 9, 30, -1000,
+	12, 11, 25, 51, 9, 9, 9, 9, 9, 62,
+	-1000, 20, 48, 9, 9, -1000, 23, 64, 64, 43,
+	-1000, 8, -6, 20, -1000, 3, -7, -1000, -4, 20,
+	20, -1000, -1000, 9, -15, -1000, 1, -1000, -17, 47,
+	20, -1000, 47, -1000, -1000, -18, 63, -1000, 63, -1000,
+	-1000,
 }
 
 var yyPgo = [...]int{
-	0, 0, 52, 51, 50, 49, 38, 48, 47, 43,
-	42, 41, 39,
+	0, 1, 96, 95, 94, 2, 93, 0, 92, 91,
+	8, 90, 81, 89, 88, 87, 85, 84, 4, 3,
 }
 
 var yyR1 = [...]int{
-	0, 11, 10, 10, 10, 10, 12, 12, 8, 7,
-	9, 1, 1, 1, 1, 1, 1, 1, 1, 2,
-	4, 4, 5, 5, 6, 3, 3,
+	0, 17, 16, 16, 16, 16, 16, 16, 16, 18,
+	18, 12, 11, 11, 14, 15, 15, 13, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 2, 8, 8,
+	9, 9, 10, 3, 3, 3, 3, 4, 4, 4,
+	5, 5, 19, 6, 6, 7, 7,
 }
 
 var yyR2 = [...]int{
-	0, 1, 3, 3, 3, 0, 1, 0, 3, 3,
-	1, 1, 1, 1, 3, 3, 3, 3, 3, 4,
-	1, 0, 3, 1, 4, 2, 0,
+	0, 1, 3, 4, 3, 3, 3, 3, 0, 1,
+	0, 3, 3, 4, 2, 4, 4, 1, 1, 1,
+	1, 1, 3, 3, 3, 3, 3, 4, 1, 0,
+	3, 1, 5, 1, 2, 3, 0, 1, 2, 3,
+	1, 3, 3, 0, 2, 1, 2,
 }
 
 var yyChk = [...]int{
-	-1000, -11, -10, -8, -7, -9, 4, 5, -1, 11,
-	6, -2, 12, -12, 13, -12, -12, -6, 11, -6,
-	8, 9, 7, 10, 12, -1, -1, 12, 13, -1,
-	-1, -1, -1, -4, -5, -1, 14, -3, 14, 15,
-	14, 11, -1,
+	-1000, -17, -16, -12, 7, -14, -15, -11, -13, 4,
+	6, 8, 9, 5, -1, 16, 11, 10, -2, 17,
+	-18, 18, -12, -18, -18, -18, -18, -10, 16, 10,
+	16, 16, -10, 10, 13, 14, 12, 15, 17, -1,
+	-18, -1, 17, 19, 19, 18, -10, -1, -1, -1,
+	-1, -8, -9, -1, 20, -3, -4, -5, 16, -1,
+	-1, 18, 20, 21, 20, -19, 21, -5, 23, 22,
+	-1, -6, 22, -19, -5, 23, -7, 16, -7, 23,
+	15,
 }
 
 var yyDef = [...]int{
-	5, -2, 1, 7, 7, 7, 0, 0, 10, 11,
-	12, 13, 0, 2, 6, 3, 4, 0, 0, 0,
-	0, 0, 0, 0, 21, 0, 8, 26, 9, 15,
-	16, 17, 18, 0, 20, 23, 14, 0, 19, 0,
-	24, 25, 22,
+	8, -2, 1, 10, 0, 10, 10, 10, 10, 0,
+	0, 0, 0, 0, 17, 18, 19, 20, 21, 0,
+	2, 9, 10, 4, 5, 6, 7, 0, 0, 14,
+	0, 0, 0, 0, 0, 0, 0, 0, 29, 0,
+	3, 11, 36, 0, 0, 12, 0, 23, 24, 25,
+	26, 0, 28, 31, 22, 0, 33, 37, 40, 15,
+	16, 13, 27, 0, 43, 34, 0, 38, 0, 0,
+	30, 32, 0, 35, 39, 0, 41, 45, 44, 42,
+	46,
 }
 
 var yyTok1 = [...]int{
@@ -184,13 +286,14 @@ var yyTok1 = [...]int{
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	12, 14, 10, 8, 15, 9, 3, 3, 3, 3,
-	3, 3, 3, 3, 3, 3, 3, 3, 3, 13,
-	7,
+	17, 20, 15, 13, 21, 14, 23, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 22, 18,
+	12, 19,
 }
 
 var yyTok2 = [...]int{
-	2, 3, 4, 5, 6, 11,
+	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
+	16,
 }
 
 var yyTok3 = [...]int{
@@ -545,107 +648,202 @@ yydefault:
 			yyVAL.program = yyDollar[1].program
 		}
 	case 3:
+		yyDollar = yyS[yypt-4 : yypt+1]
+		{
+			yyDollar[3].function.Private = true
+			yyDollar[1].program.Funcs = append(yyDollar[1].program.Funcs, yyDollar[3].function)
+			yyVAL.program = yyDollar[1].program
+		}
+	case 4:
+		yyDollar = yyS[yypt-3 : yypt+1]
+		{
+			yyDollar[1].program.Imports = append(yyDollar[1].program.Imports, yyDollar[2].importAST)
+			yyVAL.program = yyDollar[1].program
+		}
+	case 5:
+		yyDollar = yyS[yypt-3 : yypt+1]
+		{
+			yyDollar[1].program.Globals = append(yyDollar[1].program.Globals, yyDollar[2].global)
+			yyVAL.program = yyDollar[1].program
+		}
+	case 6:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
 			yyDollar[1].program.Protos = append(yyDollar[1].program.Protos, yyDollar[2].proto)
 			yyVAL.program = yyDollar[1].program
 		}
-	case 4:
+	case 7:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
 			yyDollar[1].program.Funcs = append(yyDollar[1].program.Funcs, yyDollar[2].function)
 			yyVAL.program = yyDollar[1].program
 		}
-	case 5:
+	case 8:
 		yyDollar = yyS[yypt-0 : yypt+1]
 		{
 			yyVAL.program = parser.ProgramAST{}
 		}
-	case 8:
+	case 11:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
 			yyVAL.function = parser.FunctionAST{Prototype: yyDollar[2].proto, Body: yyDollar[3].expr}
 		}
-	case 9:
+	case 12:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
 			yyVAL.proto = yyDollar[2].proto
 		}
-	case 10:
+	case 13:
+		yyDollar = yyS[yypt-4 : yypt+1]
+		{
+			yyDollar[3].proto.Library = yyDollar[2].token.Value
+			yyVAL.proto = yyDollar[3].proto
+		}
+	case 14:
+		yyDollar = yyS[yypt-2 : yypt+1]
+		{
+			yyVAL.importAST = parser.ImportAST{Path: yyDollar[2].token.Value}
+		}
+	case 15:
+		yyDollar = yyS[yypt-4 : yypt+1]
+		{
+			yyVAL.global = parser.GlobalAST{Name: yyDollar[2].token.Value, Value: yyDollar[4].expr}
+		}
+	case 16:
+		yyDollar = yyS[yypt-4 : yypt+1]
+		{
+			yyVAL.global = parser.GlobalAST{Name: yyDollar[2].token.Value, Value: yyDollar[4].expr, Const: true}
+		}
+	case 17:
 		yyDollar = yyS[yypt-1 : yypt+1]
 		{
-			yyVAL.function = parser.FunctionAST{Prototype: parser.PrototypeAST{FunctionName: "__main__", Args: []string{}}, Body: yyDollar[1].expr}
+			yyVAL.function = parser.FunctionAST{Prototype: parser.PrototypeAST{FunctionName: parser.MainFunctionName, Args: []string{}}, Body: yyDollar[1].expr}
 		}
-	case 11:
+	case 18:
 		yyDollar = yyS[yypt-1 : yypt+1]
 		{
 			yyVAL.expr = parser.VariableExprAST(yyDollar[1].token.Value)
 		}
-	case 12:
+	case 19:
 		yyDollar = yyS[yypt-1 : yypt+1]
 		{
-			yyVAL.expr = parser.NumberExprAST(yyDollar[1].token.Value)
+			yyVAL.expr = parser.NumberExprAST{Value: yyDollar[1].token.Value, Pos: yyDollar[1].token.pos}
 		}
-	case 14:
+	case 20:
+		yyDollar = yyS[yypt-1 : yypt+1]
+		{
+			yyVAL.expr = parser.StringExprAST(yyDollar[1].token.Value)
+		}
+	case 22:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
 			yyVAL.expr = yyDollar[2].expr
 		}
-	case 15:
+	case 23:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
-			yyVAL.expr = &parser.BinaryExprAST{LHS: yyDollar[1].expr, RHS: yyDollar[3].expr, Op: '+'}
+			yyVAL.expr = &parser.BinaryExprAST{LHS: yyDollar[1].expr, RHS: yyDollar[3].expr, Op: '+', Pos: yyDollar[2].token.pos}
 		}
-	case 16:
+	case 24:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
-			yyVAL.expr = &parser.BinaryExprAST{LHS: yyDollar[1].expr, RHS: yyDollar[3].expr, Op: '-'}
+			yyVAL.expr = &parser.BinaryExprAST{LHS: yyDollar[1].expr, RHS: yyDollar[3].expr, Op: '-', Pos: yyDollar[2].token.pos}
 		}
-	case 17:
+	case 25:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
-			yyVAL.expr = &parser.BinaryExprAST{LHS: yyDollar[1].expr, RHS: yyDollar[3].expr, Op: '<'}
+			yyVAL.expr = &parser.BinaryExprAST{LHS: yyDollar[1].expr, RHS: yyDollar[3].expr, Op: '<', Pos: yyDollar[2].token.pos}
 		}
-	case 18:
+	case 26:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
-			yyVAL.expr = &parser.BinaryExprAST{LHS: yyDollar[1].expr, RHS: yyDollar[3].expr, Op: '*'}
+			yyVAL.expr = &parser.BinaryExprAST{LHS: yyDollar[1].expr, RHS: yyDollar[3].expr, Op: '*', Pos: yyDollar[2].token.pos}
 		}
-	case 19:
+	case 27:
 		yyDollar = yyS[yypt-4 : yypt+1]
 		{
-			log.Println("Parsed rule: FuncExpr")
-			yyVAL.expr = &parser.CallExprAST{FunctionName: yyDollar[1].token.Value, Args: yyDollar[3].exprList}
+			yylex.(*parserContext).tracer.Debugf(trace.Parser, "Parsed rule: FuncExpr")
+			yyVAL.expr = &parser.CallExprAST{FunctionName: yyDollar[1].token.Value, Args: yyDollar[3].exprList, Pos: yyDollar[1].token.pos}
 		}
-	case 21:
+	case 29:
 		yyDollar = yyS[yypt-0 : yypt+1]
 		{
 			yyVAL.exprList = []parser.ExprAST{}
 		}
-	case 22:
+	case 30:
 		yyDollar = yyS[yypt-3 : yypt+1]
 		{
 			yyVAL.exprList = append(yyDollar[1].exprList, yyDollar[3].expr)
 		}
-	case 23:
+	case 31:
 		yyDollar = yyS[yypt-1 : yypt+1]
 		{
 			yyVAL.exprList = []parser.ExprAST{yyDollar[1].expr}
 		}
-	case 24:
-		yyDollar = yyS[yypt-4 : yypt+1]
+	case 32:
+		yyDollar = yyS[yypt-5 : yypt+1]
 		{
-			yyVAL.proto = parser.PrototypeAST{FunctionName: yyDollar[1].token.Value, Args: yyDollar[3].argList}
+			yyVAL.proto = parser.PrototypeAST{FunctionName: yyDollar[1].token.Value, Args: yyDollar[3].protoArgs.names, ReturnType: yyDollar[5].typeName, Variadic: yyDollar[3].protoArgs.variadic, Pos: yyDollar[1].token.pos}
+			if yyDollar[3].protoArgs.typed {
+				yyVAL.proto.ArgTypes = yyDollar[3].protoArgs.types
+			}
 		}
-	case 25:
+	case 34:
 		yyDollar = yyS[yypt-2 : yypt+1]
 		{
-			yyVAL.argList = append(yyDollar[1].argList, yyDollar[2].token.Value)
+			yyDollar[1].protoArgs.variadic = true
+			yyVAL.protoArgs = yyDollar[1].protoArgs
 		}
-	case 26:
+	case 35:
+		yyDollar = yyS[yypt-3 : yypt+1]
+		{
+			yyDollar[1].protoArgs.variadic = true
+			yyVAL.protoArgs = yyDollar[1].protoArgs
+		}
+	case 36:
 		yyDollar = yyS[yypt-0 : yypt+1]
 		{
-			yyVAL.argList = []string{}
+			yyVAL.protoArgs = protoArgs{names: []string{}}
+		}
+	case 38:
+		yyDollar = yyS[yypt-2 : yypt+1]
+		{
+			yyVAL.protoArgs = yyDollar[1].protoArgs.append(yyDollar[2].protoArgs)
+		}
+	case 39:
+		yyDollar = yyS[yypt-3 : yypt+1]
+		{
+			yyVAL.protoArgs = yyDollar[1].protoArgs.append(yyDollar[3].protoArgs)
+		}
+	case 40:
+		yyDollar = yyS[yypt-1 : yypt+1]
+		{
+			yyVAL.protoArgs = protoArgs{names: []string{yyDollar[1].token.Value}, types: []parser.Type{parser.TypeUnspecified}}
+		}
+	case 41:
+		yyDollar = yyS[yypt-3 : yypt+1]
+		{
+			yyVAL.protoArgs = protoArgs{names: []string{yyDollar[1].token.Value}, types: []parser.Type{yyDollar[3].typeName}, typed: true}
+		}
+	case 43:
+		yyDollar = yyS[yypt-0 : yypt+1]
+		{
+			yyVAL.typeName = parser.TypeUnspecified
+		}
+	case 44:
+		yyDollar = yyS[yypt-2 : yypt+1]
+		{
+			yyVAL.typeName = yyDollar[2].typeName
+		}
+	case 45:
+		yyDollar = yyS[yypt-1 : yypt+1]
+		{
+			yyVAL.typeName = parser.Type(yyDollar[1].token.Value)
+		}
+	case 46:
+		yyDollar = yyS[yypt-2 : yypt+1]
+		{
+			yyVAL.typeName = yyDollar[1].typeName + "*"
 		}
 	}
 	goto yystack /* stack new state and value */
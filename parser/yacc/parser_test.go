@@ -25,7 +25,10 @@ SOFTWARE.
 package yacc
 
 import (
+	"errors"
 	"testing"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
 )
 
 func TestSomeValidInput(t *testing.T) {
@@ -51,3 +54,111 @@ func TestInvalidInput(t *testing.T) {
 		}
 	}
 }
+
+func TestIncompleteInput(t *testing.T) {
+	incompleteInputs := [...]string{
+		"def test(a",
+		"def test(a) a +",
+		"(1 + 2",
+		"extern sin(x)",
+		`1 + 2; "abc`,
+	}
+	for _, input := range incompleteInputs {
+		_, err := BuildKaleidoAST(input)
+		if !errors.Is(err, ErrIncompleteInput) {
+			t.Error("Input", input, "should be incomplete, received:", err)
+		}
+	}
+	for _, input := range []string{"def a b c", `"a\0"`} {
+		if _, err := BuildKaleidoAST(input); err == nil || errors.Is(err, ErrIncompleteInput) {
+			t.Error("Invalid input", input, "should not be reported as incomplete, received:", err)
+		}
+	}
+}
+
+func TestImportAndPrivate(t *testing.T) {
+	program, err := BuildKaleidoAST(`import "lib.kal"; import "other.kal" private def helper(x) x def f(x) helper(x)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(program.Imports) != 2 || program.Imports[0].Path != "lib.kal" || program.Imports[1].Path != "other.kal" {
+		t.Error("Unexpected imports:", program.Imports)
+	}
+	if len(program.Funcs) != 2 || !program.Funcs[0].Private || program.Funcs[1].Private {
+		t.Error("Only helper should be private:", program.Funcs)
+	}
+	if _, err := BuildKaleidoAST("private extern sin(x);"); err == nil {
+		t.Error("Only definitions can be private")
+	}
+}
+
+func TestGlobalAndConst(t *testing.T) {
+	program, err := BuildKaleidoAST("const pi = 3.14159; global count = pi * 2 def f(x) x * pi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(program.Globals) != 2 || !program.Globals[0].Const || program.Globals[0].Name != "pi" ||
+		program.Globals[1].Const || program.Globals[1].Name != "count" {
+		t.Error("Unexpected globals:", program.Globals)
+	}
+	if len(program.Funcs) != 1 {
+		t.Error("Unexpected functions:", program.Funcs)
+	}
+	if _, err := BuildKaleidoAST("global x"); !errors.Is(err, ErrIncompleteInput) {
+		t.Error("A global without value should be incomplete, received:", err)
+	}
+}
+
+func TestTypeAnnotations(t *testing.T) {
+	program, err := BuildKaleidoAST("def f(n: int, x: double): double n * x\nextern g(a b: bool);\ng(1, 2 < 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := program.Funcs[0].Prototype
+	if len(f.ArgTypes) != 2 || f.ArgTypes[0] != parser.TypeInt || f.ArgTypes[1] != parser.TypeDouble || f.ReturnType != parser.TypeDouble {
+		t.Error("Unexpected types of f:", f)
+	}
+	if f.Pos != (parser.Pos{Line: 1, Column: 5}) {
+		t.Error("Unexpected position of f:", f.Pos)
+	}
+	g := program.Protos[0]
+	if g.ArgType(0) != parser.TypeDouble || g.ArgType(1) != parser.TypeBool || g.ReturnType != parser.TypeUnspecified {
+		t.Error("Unexpected types of g:", g)
+	}
+	call := program.Funcs[1].Body.(*parser.CallExprAST)
+	if call.Pos != (parser.Pos{Line: 3, Column: 1}) || call.Args[1].(*parser.BinaryExprAST).Pos != (parser.Pos{Line: 3, Column: 8}) {
+		t.Error("Unexpected positions:", call.Pos, call.Args[1])
+	}
+	if _, err := BuildKaleidoAST("def f(x: ) x"); err == nil {
+		t.Error("A type annotation without type should be rejected")
+	}
+}
+
+func TestCExtern(t *testing.T) {
+	program, err := BuildKaleidoAST(`extern printf(format: i8*, ...): i32; extern free(p: void**): void; printf("%d\n", 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printf := program.Protos[0]
+	if !printf.Variadic || printf.ArgType(0) != "i8*" || printf.ReturnType != parser.TypeI32 {
+		t.Error("Unexpected prototype of printf:", printf)
+	}
+	free := program.Protos[1]
+	if free.Variadic || free.ArgType(0) != "void**" || free.ReturnType != parser.TypeVoid {
+		t.Error("Unexpected prototype of free:", free)
+	}
+	call := program.Funcs[0].Body.(*parser.CallExprAST)
+	if format, isString := call.Args[0].(parser.StringExprAST); !isString || format != "%d\n" {
+		t.Error("Unexpected format:", call.Args[0])
+	}
+}
+
+func TestExternLibrary(t *testing.T) {
+	program, err := BuildKaleidoAST(`extern "libm.so.6" cbrt(x); extern sin(x);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.Protos[0].Library != "libm.so.6" || program.Protos[1].Library != "" {
+		t.Error("Unexpected libraries:", program.Protos[0].Library, program.Protos[1].Library)
+	}
+}
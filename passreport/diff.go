@@ -0,0 +1,159 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package passreport
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContextLines = 3
+
+type diffOperation int
+
+const (
+	diffEqual diffOperation = iota
+	diffDelete
+	diffInsert
+)
+
+type diffLine struct {
+	operation diffOperation
+	text      string
+	oldIndex  int
+	newIndex  int
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines computes the edit script between two line sequences, based on
+// their longest common subsequence.
+func diffLines(oldLines, newLines []string) []diffLine {
+	// common[i][j] is the length of the LCS of oldLines[i:] and newLines[j:].
+	common := make([][]int, len(oldLines)+1)
+	for i := range common {
+		common[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+	lines := []diffLine{}
+	i, j := 0, 0
+	for i < len(oldLines) || j < len(newLines) {
+		switch {
+		case i < len(oldLines) && j < len(newLines) && oldLines[i] == newLines[j]:
+			lines = append(lines, diffLine{diffEqual, oldLines[i], i, j})
+			i++
+			j++
+		case j == len(newLines) || (i < len(oldLines) && common[i+1][j] >= common[i][j+1]):
+			lines = append(lines, diffLine{diffDelete, oldLines[i], i, j})
+			i++
+		default:
+			lines = append(lines, diffLine{diffInsert, newLines[j], i, j})
+			j++
+		}
+	}
+	return lines
+}
+
+// UnifiedDiff returns the differences between two texts in the unified
+// format, or an empty string if they are identical.
+func UnifiedDiff(oldName, newName, oldText, newText string) string {
+	lines := diffLines(splitLines(oldText), splitLines(newText))
+	var builder strings.Builder
+	for start := 0; start < len(lines); {
+		if lines[start].operation == diffEqual {
+			start++
+			continue
+		}
+		// Extend the hunk while changes are separated by less than two contexts.
+		end := start
+		for next := start; next < len(lines); next++ {
+			if lines[next].operation != diffEqual {
+				end = next
+			} else if next-end > 2*diffContextLines {
+				break
+			}
+		}
+		hunkStart := max(start-diffContextLines, 0)
+		hunkEnd := min(end+diffContextLines+1, len(lines))
+		if builder.Len() == 0 {
+			fmt.Fprintf(&builder, "--- %s\n+++ %s\n", oldName, newName)
+		}
+		writeHunk(&builder, lines[hunkStart:hunkEnd])
+		start = hunkEnd
+	}
+	return builder.String()
+}
+
+func writeHunk(builder *strings.Builder, hunk []diffLine) {
+	oldCount, newCount := 0, 0
+	for _, line := range hunk {
+		if line.operation != diffInsert {
+			oldCount++
+		}
+		if line.operation != diffDelete {
+			newCount++
+		}
+	}
+	fmt.Fprintf(builder, "@@ -%d,%d +%d,%d @@\n", hunk[0].oldIndex+1, oldCount, hunk[0].newIndex+1, newCount)
+	for _, line := range hunk {
+		prefix := " "
+		switch line.operation {
+		case diffDelete:
+			prefix = "-"
+		case diffInsert:
+			prefix = "+"
+		}
+		builder.WriteString(prefix + line.text + "\n")
+	}
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
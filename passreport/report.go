@@ -0,0 +1,162 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package passreport renders the IR of a function after each optimization
+// pass, as unified diffs between stages and as an HTML report.
+package passreport
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+// Stage is the state of a function after one step of its optimization.
+type Stage struct {
+	Pass             string
+	IR               string
+	InstructionCount int
+}
+
+// FunctionReport gathers the optimization stages of a function.
+type FunctionReport struct {
+	Function string
+	Stages   []Stage
+}
+
+// stageDiff is the change made by one stage, compared to the previous one.
+func (r FunctionReport) stageDiff(index int) string {
+	previous, current := r.Stages[index-1], r.Stages[index]
+	return UnifiedDiff(previous.Pass, current.Pass, previous.IR, current.IR)
+}
+
+// WriteText writes the diff after each stage and a summary of the
+// instruction counts.
+func WriteText(w io.Writer, report FunctionReport) {
+	fmt.Fprintf(w, "*** Optimization of %s ***\n", report.Function)
+	for i := 1; i < len(report.Stages); i++ {
+		fmt.Fprintf(w, "*** IR after %s ***\n", report.Stages[i].Pass)
+		if diff := report.stageDiff(i); diff != "" {
+			fmt.Fprint(w, diff)
+		} else {
+			fmt.Fprintln(w, "(no change)")
+		}
+	}
+	WriteSummary(w, report)
+}
+
+// WriteSummary writes the number of instructions of the function after
+// each stage.
+func WriteSummary(w io.Writer, report FunctionReport) {
+	fmt.Fprintf(w, "*** Instruction count of %s ***\n", report.Function)
+	for _, stage := range report.Stages {
+		fmt.Fprintf(w, "  %-24s %d\n", stage.Pass, stage.InstructionCount)
+	}
+}
+
+type htmlStage struct {
+	Pass             string
+	InstructionCount int
+	Lines            []htmlDiffLine
+}
+
+type htmlDiffLine struct {
+	Class string
+	Text  string
+}
+
+type htmlFunction struct {
+	Function string
+	Input    string
+	Stages   []htmlStage
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Kaleidoscope optimization report</title>
+<style>
+body { font-family: sans-serif; }
+pre { background: #f6f6f6; padding: 0.5em; }
+.add { color: #22863a; background: #f0fff4; }
+.del { color: #b31d28; background: #ffeef0; }
+.hunk { color: #6f42c1; }
+td, th { padding: 0 1em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Kaleidoscope optimization report</h1>
+{{range .}}
+<h2>{{.Function}}</h2>
+<table>
+<tr><th>Stage</th><th>Instructions</th></tr>
+{{range .Stages}}<tr><td>{{.Pass}}</td><td>{{.InstructionCount}}</td></tr>
+{{end}}
+</table>
+<details><summary>Input IR</summary><pre>{{.Input}}</pre></details>
+{{range .Stages}}{{if .Lines}}
+<h3>After {{.Pass}}</h3>
+<pre>{{range .Lines}}<span class="{{.Class}}">{{.Text}}</span>
+{{end}}</pre>
+{{end}}{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes a standalone HTML page with the stages of all the reports.
+func WriteHTML(w io.Writer, reports []FunctionReport) error {
+	functions := make([]htmlFunction, 0, len(reports))
+	for _, report := range reports {
+		if len(report.Stages) == 0 {
+			continue
+		}
+		function := htmlFunction{Function: report.Function, Input: report.Stages[0].IR}
+		for i, stage := range report.Stages {
+			htmlStage := htmlStage{Pass: stage.Pass, InstructionCount: stage.InstructionCount}
+			if i > 0 {
+				for _, line := range splitLines(report.stageDiff(i)) {
+					htmlStage.Lines = append(htmlStage.Lines, htmlDiffLine{Class: diffLineClass(line), Text: line})
+				}
+			}
+			function.Stages = append(function.Stages, htmlStage)
+		}
+		functions = append(functions, function)
+	}
+	return htmlTemplate.Execute(w, functions)
+}
+
+func diffLineClass(line string) string {
+	switch {
+	case strings.HasPrefix(line, "@@"):
+		return "hunk"
+	case strings.HasPrefix(line, "+"):
+		return "add"
+	case strings.HasPrefix(line, "-"):
+		return "del"
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package passreport
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	oldText := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	newText := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	expected := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -8,3 +8,4 @@
+ h
+ i
+ j
++k
+`
+	if diff := UnifiedDiff("old", "new", oldText, newText); diff != expected {
+		t.Errorf("Was waiting for:\n%s\nbut received:\n%s", expected, diff)
+	}
+	if diff := UnifiedDiff("old", "new", oldText, oldText); diff != "" {
+		t.Errorf("Identical texts should give an empty diff, received:\n%s", diff)
+	}
+}
+
+func TestReports(t *testing.T) {
+	report := FunctionReport{Function: "f", Stages: []Stage{
+		{Pass: "input", IR: "%1 = fadd\n%2 = fadd\nret\n", InstructionCount: 3},
+		{Pass: "gvn", IR: "%1 = fadd\nret\n", InstructionCount: 2},
+		{Pass: "dse", IR: "%1 = fadd\nret\n", InstructionCount: 2},
+	}}
+	var text strings.Builder
+	WriteText(&text, report)
+	for _, expected := range []string{"*** IR after gvn ***", "-%2 = fadd", "(no change)", "  gvn                      2"} {
+		if !strings.Contains(text.String(), expected) {
+			t.Errorf("Missing %q in text report:\n%s", expected, text.String())
+		}
+	}
+	var html strings.Builder
+	if err := WriteHTML(&html, []FunctionReport{report}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html.String(), `<span class="del">-%2 = fadd</span>`) {
+		t.Errorf("Missing deleted line in HTML report:\n%s", html.String())
+	}
+}
@@ -0,0 +1,180 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterh/liner"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser/yacc"
+)
+
+const (
+	replPrompt             = "kaleido> "
+	replContinuationPrompt = "     ... "
+	replHistoryFile        = ".kaleido_history"
+	replTranscriptFile     = ".kaleido_transcript.kal"
+)
+
+type replConfig struct {
+	sessionFile    string
+	transcriptFile string
+}
+
+func startREPL(config replConfig) {
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	historyPath := historyFilePath()
+	loadHistory(line, historyPath)
+	defer saveHistory(line, historyPath)
+
+	session, err := newReplSession()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer session.close()
+	if config.transcriptFile != EMPTY_STRING {
+		transcript, err := openTranscript(config.transcriptFile)
+		if err != nil {
+			fmt.Println("Cannot open transcript:", err)
+		} else {
+			session.setTranscript(transcript)
+			defer transcript.Close()
+		}
+	}
+	if config.sessionFile != EMPTY_STRING {
+		if _, err := os.Stat(config.sessionFile); err == nil {
+			if err := session.restore(config.sessionFile); err != nil {
+				fmt.Println("Cannot restore session:", err)
+			}
+		}
+		defer func() {
+			if err := saveSession(&session.visitor, config.sessionFile); err != nil {
+				fmt.Println("Cannot save session:", err)
+			}
+		}()
+	}
+	var pendingInput strings.Builder
+	for {
+		prompt := replPrompt
+		if pendingInput.Len() != 0 {
+			prompt = replContinuationPrompt
+		}
+		input, err := line.Prompt(prompt)
+		switch {
+		case err == liner.ErrPromptAborted:
+			// Ctrl-C cancels the current input, which may span several lines.
+			pendingInput.Reset()
+			continue
+		case err == io.EOF:
+			fmt.Println()
+			return
+		case err != nil:
+			fmt.Println(err)
+			return
+		}
+		if strings.TrimSpace(input) != EMPTY_STRING {
+			line.AppendHistory(input)
+		}
+		if pendingInput.Len() == 0 && isReplCommand(input) {
+			session.transcript.recordComment(input)
+			if err := runReplCommand(session, input); err != nil {
+				fmt.Fprintln(session.output, err)
+			}
+			continue
+		}
+		pendingInput.WriteString(input)
+		pendingInput.WriteString("\n")
+		source := pendingInput.String()
+		if strings.TrimSpace(source) == EMPTY_STRING {
+			pendingInput.Reset()
+			continue
+		}
+		kaleidoAST, err := parse(source)
+		if errors.Is(err, yacc.ErrIncompleteInput) {
+			continue
+		}
+		pendingInput.Reset()
+		session.transcript.recordInput(source)
+		if err == nil {
+			kaleidoAST, err = session.loader.Resolve(kaleidoAST, ".")
+		}
+		if err != nil {
+			fmt.Fprintln(session.output, err)
+			continue
+		}
+		if err := session.process(kaleidoAST); err != nil {
+			fmt.Fprintln(session.output, err)
+		}
+	}
+}
+
+func historyFilePath() string {
+	return homeFilePath(replHistoryFile)
+}
+
+func defaultTranscriptPath() string {
+	return homeFilePath(replTranscriptFile)
+}
+
+func homeFilePath(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return EMPTY_STRING
+	}
+	return filepath.Join(home, name)
+}
+
+func loadHistory(line *liner.State, path string) {
+	if path == EMPTY_STRING {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	line.ReadHistory(file)
+}
+
+func saveHistory(line *liner.State, path string) {
+	if path == EMPTY_STRING {
+		return
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		fmt.Println("Cannot save history:", err)
+		return
+	}
+	defer file.Close()
+	line.WriteHistory(file)
+}
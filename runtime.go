@@ -0,0 +1,129 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/kaleidort"
+)
+
+const runtimeUsage = `Usage: kaleido runtime [options]
+
+Build the runtime library as a static library, to link with the programs
+compiled by build. The C compiler and archiver are given by the CC and AR
+environment variables, cc and ar by default.
+
+Options:
+`
+
+// runRuntime implements the runtime subcommand, and returns the exit code.
+func runRuntime(args []string) int {
+	flags := flag.NewFlagSet("runtime", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), runtimeUsage)
+		flags.PrintDefaults()
+	}
+	outputPtr := flags.String("o", "libkaleidort.a", "Output static library")
+	sourcesPtr := flags.String("sources", EMPTY_STRING, "Only write the C sources of the runtime into the directory")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	var err error
+	if *sourcesPtr != EMPTY_STRING {
+		err = writeRuntimeSources(*sourcesPtr)
+	} else {
+		err = buildRuntimeLibrary(*outputPtr)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func writeRuntimeSources(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return fs.WalkDir(kaleidort.Sources, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := kaleidort.Sources.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, path), data, 0644)
+	})
+}
+
+// buildRuntimeLibrary compiles the C sources of the runtime into a static
+// library.
+func buildRuntimeLibrary(output string) error {
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "kaleidort")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := writeRuntimeSources(dir); err != nil {
+		return err
+	}
+	if err := runTool(dir, toolFromEnv("CC", "cc"), "-c", "-O2", "-fPIC", "kaleido_runtime.c", "-o", "kaleido_runtime.o"); err != nil {
+		return err
+	}
+	os.Remove(output)
+	return runTool(dir, toolFromEnv("AR", "ar"), "rcs", output, "kaleido_runtime.o")
+}
+
+func toolFromEnv(variable string, defaultTool string) string {
+	if tool := os.Getenv(variable); tool != EMPTY_STRING {
+		return tool
+	}
+	return defaultTool
+}
+
+func runTool(dir string, tool string, args ...string) error {
+	cmd := exec.Command(tool, args...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", tool, err)
+	}
+	return nil
+}
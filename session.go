@@ -0,0 +1,128 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/visitor"
+)
+
+const transcriptCommentPrefix = "# "
+
+// saveSession writes the accepted definitions, in order, as a source file
+// which can be replayed to restore the session. Definitions coming from an
+// imported file are saved as an import of the file.
+func saveSession(kaleidoVisitor *visitor.VisitorKaleido, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "# Kaleidoscope session saved on %s\n", time.Now().Format(time.RFC3339))
+	imported := make(map[string]bool)
+	for _, definition := range kaleidoVisitor.AcceptedDefinitions() {
+		file := definitionFile(definition)
+		switch {
+		case file == EMPTY_STRING:
+			fmt.Fprintln(writer, visitor.FormatDefinition(definition))
+		case !imported[file]:
+			imported[file] = true
+			fmt.Fprintf(writer, "import \"%s\";\n", file)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func definitionFile(definition parser.Visitable) string {
+	switch node := definition.(type) {
+	case *parser.PrototypeAST:
+		return node.File
+	case *parser.FunctionAST:
+		return node.Prototype.File
+	}
+	return EMPTY_STRING
+}
+
+// transcript logs the inputs of a REPL session to a file. Outputs are
+// written as comments so the transcript stays a valid Kaleidoscope source.
+// A nil transcript discards everything.
+type transcript struct {
+	file *os.File
+}
+
+func openTranscript(path string) (*transcript, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(file, "\n# Session started on %s\n", time.Now().Format(time.RFC3339))
+	return &transcript{file: file}, nil
+}
+
+func (t *transcript) recordInput(input string) {
+	if t == nil {
+		return
+	}
+	fmt.Fprint(t.file, input)
+	if !strings.HasSuffix(input, "\n") {
+		fmt.Fprintln(t.file)
+	}
+}
+
+func (t *transcript) recordComment(comment string) {
+	t.Write([]byte(comment + "\n"))
+}
+
+func (t *transcript) Write(p []byte) (int, error) {
+	if t == nil {
+		return len(p), nil
+	}
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == EMPTY_STRING {
+			continue
+		}
+		if _, err := fmt.Fprint(t.file, transcriptCommentPrefix+line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (t *transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.file.Close()
+}
@@ -0,0 +1,148 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package trace provides leveled tracing of the compiler, by category. A nil
+// Tracer is valid and traces nothing, so the compiler is quiet by default.
+package trace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+type Category int
+
+const (
+	Lexer Category = iota
+	Parser
+	Codegen
+	Passes
+	JIT
+	categoryCount
+)
+
+var categoryNames = [categoryCount]string{"lexer", "parser", "codegen", "passes", "jit"}
+
+func (c Category) String() string {
+	if c < 0 || c >= categoryCount {
+		return fmt.Sprintf("Category(%d)", int(c))
+	}
+	return categoryNames[c]
+}
+
+// AllCategories lists every category, in order.
+func AllCategories() []Category {
+	categories := make([]Category, 0, categoryCount)
+	for c := Category(0); c < categoryCount; c++ {
+		categories = append(categories, c)
+	}
+	return categories
+}
+
+// ParseCategories reads a comma separated list of category names, "all"
+// selecting every category.
+func ParseCategories(list string) ([]Category, error) {
+	categories := []Category{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			return AllCategories(), nil
+		}
+		found := false
+		for c, categoryName := range categoryNames {
+			if categoryName == name {
+				categories = append(categories, Category(c))
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("Unknown trace category: " + name)
+		}
+	}
+	return categories, nil
+}
+
+type Level int
+
+const (
+	LevelNone Level = iota
+	LevelInfo
+	LevelDebug
+)
+
+type Tracer struct {
+	mutex  sync.Mutex
+	output io.Writer
+	levels [categoryCount]Level
+}
+
+// New returns a tracer writing to output, with every category disabled.
+func New(output io.Writer) *Tracer {
+	return &Tracer{output: output}
+}
+
+// Enable sets the level of the given categories.
+func (t *Tracer) Enable(level Level, categories ...Category) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, category := range categories {
+		t.levels[category] = level
+	}
+}
+
+func (t *Tracer) Enabled(category Category, level Level) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return level != LevelNone && t.levels[category] >= level
+}
+
+func (t *Tracer) Printf(category Category, level Level, format string, args ...interface{}) {
+	if !t.Enabled(category, level) {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	fmt.Fprintf(t.output, "[%s] %s", category, message)
+	if !strings.HasSuffix(message, "\n") {
+		fmt.Fprintln(t.output)
+	}
+}
+
+func (t *Tracer) Infof(category Category, format string, args ...interface{}) {
+	t.Printf(category, LevelInfo, format, args...)
+}
+
+func (t *Tracer) Debugf(category Category, format string, args ...interface{}) {
+	t.Printf(category, LevelDebug, format, args...)
+}
@@ -0,0 +1,66 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trace
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNilTracerIsQuiet(t *testing.T) {
+	var tracer *Tracer
+	if tracer.Enabled(Codegen, LevelInfo) {
+		t.Error("A nil tracer should not be enabled")
+	}
+	tracer.Infof(Codegen, "Should not panic")
+}
+
+func TestLevelsAndCategories(t *testing.T) {
+	var output strings.Builder
+	tracer := New(&output)
+	tracer.Enable(LevelInfo, Codegen)
+	tracer.Infof(Codegen, "shown")
+	tracer.Debugf(Codegen, "hidden, level too high")
+	tracer.Infof(JIT, "hidden, category disabled")
+	if output.String() != "[codegen] shown\n" {
+		t.Errorf("Unexpected output: %q", output.String())
+	}
+}
+
+func TestParseCategories(t *testing.T) {
+	categories, err := ParseCategories("codegen, jit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(categories) != 2 || categories[0] != Codegen || categories[1] != JIT {
+		t.Error("Unexpected categories", categories)
+	}
+	if categories, _ := ParseCategories("all"); len(categories) != len(AllCategories()) {
+		t.Error("all should select every category")
+	}
+	if _, err := ParseCategories("codegen,unknown"); err == nil {
+		t.Error("Was waiting for an error")
+	}
+}
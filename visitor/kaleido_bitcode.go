@@ -0,0 +1,104 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+/*
+#include "llvm-c/BitReader.h"
+#include "llvm-c/Core.h"
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"io/ioutil"
+	"unsafe"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+)
+
+// The bindings only parse bitcode into the global context, while each
+// visitor, and each worker of a parallel compilation, owns its context.
+
+// parseBitcode returns a module parsed from bitcode into the given context.
+func parseBitcode(context llvm.Context, data []byte) (llvm.Module, error) {
+	if len(data) == 0 {
+		return llvm.Module{}, errors.New("Empty bitcode")
+	}
+	name := C.CString("bitcode")
+	defer C.free(unsafe.Pointer(name))
+	buffer := C.LLVMCreateMemoryBufferWithMemoryRangeCopy((*C.char)(unsafe.Pointer(&data[0])), C.size_t(len(data)), name)
+	defer C.LLVMDisposeMemoryBuffer(buffer)
+	var moduleRef C.LLVMModuleRef
+	contextRef := C.LLVMContextRef(unsafe.Pointer(context.C))
+	if C.LLVMParseBitcodeInContext2(contextRef, buffer, &moduleRef) != 0 {
+		return llvm.Module{}, errors.New("Invalid bitcode")
+	}
+	// llvm.Module only wraps the module reference.
+	return *(*llvm.Module)(unsafe.Pointer(&moduleRef)), nil
+}
+
+func parseBitcodeFile(context llvm.Context, path string) (llvm.Module, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return llvm.Module{}, err
+	}
+	return parseBitcode(context, data)
+}
+
+// writeBitcode returns the bitcode of a module.
+func writeBitcode(module llvm.Module) []byte {
+	buffer := llvm.WriteBitcodeToMemoryBuffer(module)
+	defer buffer.Dispose()
+	return append([]byte{}, buffer.Bytes()...)
+}
+
+// linkFunction links into the current module a module holding a single
+// function definition, renamed to the given name.
+func (v *VisitorKaleido) linkFunction(module llvm.Module, name string) (llvm.Value, bool) {
+	var definedFunc llvm.Value
+	for function := module.FirstFunction(); !function.IsNil(); function = llvm.NextFunction(function) {
+		if !function.IsDeclaration() {
+			definedFunc = function
+		}
+	}
+	if definedFunc.IsNil() {
+		module.Dispose()
+		return llvm.Value{}, false
+	}
+	definedFunc.SetName(name)
+	if err := llvm.LinkModules(*v.lastModule, module); err != nil {
+		return llvm.Value{}, false
+	}
+	return v.lastModule.NamedFunction(name), true
+}
+
+func (v *VisitorKaleido) linkCompiledFunction(module llvm.Module, name string) llvm.Value {
+	llvmFunc, linked := v.linkFunction(module, name)
+	if !linked {
+		panic("Cannot link the compiled function " + name)
+	}
+	return llvmFunc
+}
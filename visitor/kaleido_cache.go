@@ -0,0 +1,247 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
+)
+
+// cacheFormatVersion must be changed when the generated code changes for the
+// same source, so previous entries are not used anymore.
+const cacheFormatVersion = 6
+
+// CompilationCache stores on disk the optimized bitcode of the functions
+// compiled for the JIT. A function found in the cache is neither generated
+// nor optimized again. The cache is only an accelerator: a broken entry or
+// directory is ignored.
+type CompilationCache struct {
+	dir    string
+	hits   int
+	misses int
+}
+
+// NewCompilationCache returns a cache stored in dir, created when needed.
+func NewCompilationCache(dir string) *CompilationCache {
+	return &CompilationCache{dir: dir}
+}
+
+// Stats returns the number of functions found and not found in the cache.
+func (c *CompilationCache) Stats() (hits int, misses int) {
+	return c.hits, c.misses
+}
+
+func (c *CompilationCache) entryPath(key string) string {
+	return filepath.Join(c.dir, key+".bc")
+}
+
+// lookup tells if the cache holds an entry for the key.
+func (c *CompilationCache) lookup(key string) bool {
+	if _, err := os.Stat(c.entryPath(key)); err != nil {
+		c.misses++
+		return false
+	}
+	c.hits++
+	return true
+}
+
+// load returns the module stored for the key, holding a single function
+// definition.
+func (c *CompilationCache) load(key string, context llvm.Context) (llvm.Module, error) {
+	return parseBitcodeFile(context, c.entryPath(key))
+}
+
+// store writes the module for the key. The file is renamed once complete,
+// so concurrent processes sharing the cache never read a partial entry.
+func (c *CompilationCache) store(key string, module llvm.Module) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(c.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := llvm.WriteBitcodeToFile(module, file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), c.entryPath(key))
+}
+
+// cacheKey hashes what the code of a function depends on: its normalized
+// source, the prototypes of the functions it calls, transitively, the values
+// of the constants it reads and the compiler options. An empty key means the function must not be cached.
+func (v *VisitorKaleido) cacheKey(node *parser.FunctionAST, name string) string {
+	if v.cache == nil || v.passObserver != nil || name == parser.MainFunctionName {
+		return ""
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "kaleido cache %d\n%s\n%+v\n", cacheFormatVersion, llvm.DefaultTargetTriple(), v.optimization)
+	fmt.Fprintf(hash, "instrumented %t\n", v.instrumented())
+	fmt.Fprintf(hash, "%s %s\n", name, FormatDefinition(node))
+	if !v.hashVariables(hash, node) {
+		return ""
+	}
+	visited := map[string]bool{name: true}
+	pending := v.calleeNames(node.Body)
+	sort.Strings(pending)
+	for len(pending) != 0 {
+		callee := pending[0]
+		pending = pending[1:]
+		if visited[callee] {
+			continue
+		}
+		visited[callee] = true
+		prototype, found := v.prototypes[callee]
+		if !found {
+			// The compilation will fail, nothing to look up.
+			return ""
+		}
+		fmt.Fprintf(hash, "%s %s %s\n", callee, v.calleeSymbol(callee, len(prototype.Args)), signature(prototype))
+		pending = append(pending, v.dependencies[callee]...)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// hashVariables hashes how the variables of a function which are not its
+// arguments are compiled: folded constants or loaded globals. It returns
+// false for an unknown variable.
+func (v *VisitorKaleido) hashVariables(hash io.Writer, node *parser.FunctionAST) bool {
+	args := make(map[string]bool, len(node.Prototype.Args))
+	for _, arg := range node.Prototype.Args {
+		args[arg] = true
+	}
+	for _, variable := range collectVariables(node.Body) {
+		name := string(variable)
+		if args[name] {
+			continue
+		}
+		if value, found := v.constants[name]; found {
+			fmt.Fprintf(hash, "const %s %x\n", name, math.Float64bits(value))
+		} else if _, found := v.globals[name]; found {
+			fmt.Fprintf(hash, "global %s\n", name)
+		} else {
+			return false
+		}
+	}
+	return true
+}
+
+// loadFromCache adds to the current module the cached function for the key,
+// renamed to the given name.
+func (v *VisitorKaleido) loadFromCache(key string, name string) (llvm.Value, bool) {
+	if key == "" {
+		return llvm.Value{}, false
+	}
+	if !v.cache.lookup(key) {
+		return llvm.Value{}, false
+	}
+	module, err := v.cache.load(key, *v.context)
+	if err != nil {
+		return llvm.Value{}, false
+	}
+	return v.linkFunction(module, name)
+}
+
+// storeInCache saves the current module, which must only hold the optimized
+// function and declarations.
+func (v *VisitorKaleido) storeInCache(key string) {
+	if key == "" {
+		return
+	}
+	if err := v.cache.store(key, *v.lastModule); err != nil {
+		v.tracer.Infof(trace.Codegen, "Cannot write the compilation cache: %v", err)
+	}
+}
+
+// calleeNames returns the names of the functions called by an expression,
+// as resolved from the current file.
+func (v *VisitorKaleido) calleeNames(expr parser.ExprAST) []string {
+	names := []string{}
+	for _, call := range v.collectCalls(expr) {
+		names = append(names, v.resolveFunction(call.FunctionName))
+	}
+	return names
+}
+
+// calleeSymbols returns the symbols called by an expression, as recorded
+// while generating its code.
+func (v *VisitorKaleido) calleeSymbols(expr parser.ExprAST) []string {
+	symbols := []string{}
+	for _, call := range v.collectCalls(expr) {
+		symbols = append(symbols, v.calleeSymbol(v.resolveFunction(call.FunctionName), len(call.Args)))
+	}
+	return symbols
+}
+
+// collectCalls returns the calls of an expression, conversions excluded.
+func (v *VisitorKaleido) collectCalls(expr parser.ExprAST) []*parser.CallExprAST {
+	switch node := expr.(type) {
+	case *parser.BinaryExprAST:
+		return append(v.collectCalls(node.LHS), v.collectCalls(node.RHS)...)
+	case *parser.CallExprAST:
+		calls := []*parser.CallExprAST{}
+		if !v.isConversion(node) {
+			calls = append(calls, node)
+		}
+		for _, arg := range node.Args {
+			calls = append(calls, v.collectCalls(arg)...)
+		}
+		return calls
+	}
+	return nil
+}
+
+func collectVariables(expr parser.ExprAST) []parser.VariableExprAST {
+	switch node := expr.(type) {
+	case parser.VariableExprAST:
+		return []parser.VariableExprAST{node}
+	case *parser.BinaryExprAST:
+		return append(collectVariables(node.LHS), collectVariables(node.RHS)...)
+	case *parser.CallExprAST:
+		variables := []parser.VariableExprAST{}
+		for _, arg := range node.Args {
+			variables = append(variables, collectVariables(arg)...)
+		}
+		return variables
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+/*
+#include "llvm-c/Support.h"
+#include <setjmp.h>
+#include <stddef.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+
+typedef double (*kaleido_entry_point)(const double *);
+
+enum {
+	KALEIDO_COMPLETED,
+	KALEIDO_INTERRUPTED,
+	KALEIDO_RECURSION_LIMIT,
+	KALEIDO_GO_FUNCTION_FAILED,
+};
+
+// kaleido_call_state is the state of a call from Go.
+typedef struct {
+	int interrupted;
+	int depth;
+	int limit;
+	// output is the id of the Go writer of the output, 0 for stdout.
+	long long output;
+	// function is the function exceeding the recursion limit.
+	const char *function;
+	// random is the state of the random numbers of the visitor.
+	uint64_t *random;
+	// flush tells whether the program declares C functions, which may
+	// write to stdout.
+	int flush;
+	jmp_buf jump;
+} kaleido_call_state;
+
+static __thread kaleido_call_state *kaleido_current_call;
+
+// kaleido_enter is called at the entry of the instrumented functions. It
+// jumps back to kaleido_call once the call is interrupted or too deep. The
+// skipped frames are only generated code, with nothing to release.
+static void kaleido_enter(const char *function) {
+	kaleido_call_state *state = kaleido_current_call;
+	if (state == NULL) {
+		return;
+	}
+	if (__atomic_load_n(&state->interrupted, __ATOMIC_ACQUIRE)) {
+		longjmp(state->jump, KALEIDO_INTERRUPTED);
+	}
+	state->depth++;
+	if (state->limit > 0 && state->depth > state->limit) {
+		state->function = function;
+		longjmp(state->jump, KALEIDO_RECURSION_LIMIT);
+	}
+}
+
+// kaleido_leave is called when an instrumented function returns, after its
+// last call.
+static void kaleido_leave(void) {
+	kaleido_call_state *state = kaleido_current_call;
+	if (state != NULL) {
+		state->depth--;
+	}
+}
+
+static int kaleido_call(void *entry, const double *args, kaleido_call_state *state, double *result) {
+	kaleido_call_state *previous = kaleido_current_call;
+	kaleido_current_call = state;
+	int status = setjmp(state->jump);
+	if (status == KALEIDO_COMPLETED) {
+		*result = ((kaleido_entry_point)entry)(args);
+	}
+	// The C functions called from Kaleidoscope, such as printf, write to
+	// the buffered stdout, flushed so their output comes before what Go
+	// prints next.
+	if (state->flush) {
+		fflush(stdout);
+	}
+	kaleido_current_call = previous;
+	return status;
+}
+
+// Exported from kaleido_gofunc.go.
+extern double kaleidoGoFunction(long long id, double *args, void *state, int *failed);
+
+// kaleido_call_go is called by the adapters of the Go functions, and jumps
+// back to kaleido_call once the Go function returned if it failed.
+static double kaleido_call_go(long long id, double *args) {
+	kaleido_call_state *state = kaleido_current_call;
+	int failed = 0;
+	double result = kaleidoGoFunction(id, args, state, &failed);
+	if (failed && state != NULL) {
+		longjmp(state->jump, KALEIDO_GO_FUNCTION_FAILED);
+	}
+	return result;
+}
+
+// Exported from kaleido_output.go.
+extern void kaleidoWriteOutput(long long output, char *data, size_t size);
+
+// kaleido_write writes the output of the runtime library to the writer of
+// the current call.
+static void kaleido_write(const char *data, size_t size) {
+	kaleido_call_state *state = kaleido_current_call;
+	if (state != NULL && state->output != 0) {
+		kaleidoWriteOutput(state->output, (char *)data, size);
+		return;
+	}
+	fwrite(data, 1, size, stdout);
+	fflush(stdout);
+}
+
+static void *kaleido_write_address(void) {
+	return (void *)kaleido_write;
+}
+
+// kaleido_random_state returns the state of the random numbers of the
+// visitor of the current call, so each visitor has its own sequence.
+static uint64_t *kaleido_random_state(void) {
+	kaleido_call_state *state = kaleido_current_call;
+	return state != NULL ? state->random : NULL;
+}
+
+static void *kaleido_random_state_address(void) {
+	return (void *)kaleido_random_state;
+}
+
+static void *kaleido_call_go_address(void) {
+	return (void *)kaleido_call_go;
+}
+
+static void kaleido_interrupt(kaleido_call_state *state) {
+	__atomic_store_n(&state->interrupted, 1, __ATOMIC_RELEASE);
+}
+
+static void kaleido_register_runtime(void) {
+	LLVMAddSymbol("kaleido.enter", (void *)kaleido_enter);
+	LLVMAddSymbol("kaleido.leave", (void *)kaleido_leave);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/kaleidort"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
+)
+
+// Functions of the runtime called by the instrumented functions.
+const (
+	enterSymbol  = "kaleido.enter"
+	leaveSymbol  = "kaleido.leave"
+	goCallSymbol = "kaleido.go"
+)
+
+// DefaultRecursionLimit is a depth of calls far from exhausting the stack
+// of a thread.
+const DefaultRecursionLimit = 10000
+
+func init() {
+	C.kaleido_register_runtime()
+	kaleidort.SetWriter(C.kaleido_write_address())
+	kaleidort.SetRandomSource(C.kaleido_random_state_address())
+}
+
+// RecursionLimitError is returned when a call exceeds the recursion limit,
+// see SetRecursionLimit.
+type RecursionLimitError struct {
+	Function string
+	Limit    int
+}
+
+func (e *RecursionLimitError) Error() string {
+	return fmt.Sprintf("Recursion limit exceeded in function %s, more than %d nested calls", e.Function, e.Limit)
+}
+
+// CompiledFunction is a function of the JIT called directly from Go. It
+// calls the stub of the function, so the latest definition with the same
+// number of arguments is run. Unlike the visitor, it can be called from
+// several goroutines at once, even while other definitions are compiled.
+type CompiledFunction struct {
+	name     string
+	arity    int
+	entry    unsafe.Pointer
+	settings *callSettings
+}
+
+// callSettings are the settings of the calls from Go, shared by a visitor
+// and its compiled functions, and accessed atomically.
+type callSettings struct {
+	recursionLimit int32
+	// output is the id of the writer of the output, 0 for the standard
+	// output.
+	output int64
+	// random is the state of the random numbers, out of the Go heap.
+	random unsafe.Pointer
+	// flushStdout is set once a C function is declared, stdout being
+	// flushed after each call from then on.
+	flushStdout int32
+}
+
+func newCallSettings() *callSettings {
+	return &callSettings{random: kaleidort.NewRandomState()}
+}
+
+// free releases the state of the random numbers, once the visitor closed.
+func (s *callSettings) free() {
+	kaleidort.FreeRandomState(s.random)
+	s.random = nil
+}
+
+// Name returns the name of the function.
+func (f *CompiledFunction) Name() string {
+	return f.name
+}
+
+// Arity returns the number of arguments of the function.
+func (f *CompiledFunction) Arity() int {
+	return f.arity
+}
+
+// Call runs the function with the given arguments.
+func (f *CompiledFunction) Call(args ...float64) (float64, error) {
+	return f.CallContext(context.Background(), args...)
+}
+
+// CallContext runs the function with the given arguments, and stops it with
+// the error of the context once done. Only the functions compiled while the
+// visitor is interruptible can be stopped, see SetInterruptible.
+func (f *CompiledFunction) CallContext(ctx context.Context, args ...float64) (float64, error) {
+	if len(args) != f.arity {
+		return 0, fmt.Errorf("Function %s takes %d arguments, not %d", f.name, f.arity, len(args))
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var argsPtr *C.double
+	if len(args) != 0 {
+		argsPtr = (*C.double)(unsafe.Pointer(&args[0]))
+	}
+	// The state is shared with the generated code, out of the Go heap.
+	state := (*C.kaleido_call_state)(C.calloc(1, C.sizeof_kaleido_call_state))
+	defer C.free(unsafe.Pointer(state))
+	limit := atomic.LoadInt32(&f.settings.recursionLimit)
+	state.limit = C.int(limit)
+	state.output = C.longlong(atomic.LoadInt64(&f.settings.output))
+	state.random = (*C.uint64_t)(f.settings.random)
+	state.flush = C.int(atomic.LoadInt32(&f.settings.flushStdout))
+	if ctx.Done() != nil {
+		returned := make(chan struct{})
+		watched := make(chan struct{})
+		go func() {
+			defer close(watched)
+			select {
+			case <-ctx.Done():
+				C.kaleido_interrupt(state)
+			case <-returned:
+			}
+		}()
+		defer func() {
+			close(returned)
+			<-watched
+		}()
+	}
+	var result C.double
+	switch C.kaleido_call(f.entry, argsPtr, state, &result) {
+	case C.KALEIDO_INTERRUPTED:
+		return 0, ctx.Err()
+	case C.KALEIDO_GO_FUNCTION_FAILED:
+		return 0, goFunctionError(unsafe.Pointer(state))
+	case C.KALEIDO_RECURSION_LIMIT:
+		return 0, &RecursionLimitError{Function: C.GoString(state.function), Limit: int(limit)}
+	}
+	return float64(result), nil
+}
+
+// CompiledFunction returns the function with the given name, compiling an
+// entry point taking its arguments as an array the first time.
+func (v *VisitorKaleido) CompiledFunction(name string) (*CompiledFunction, error) {
+	if v.jit == nil {
+		return nil, fmt.Errorf("No JIT to run %s, the program is compiled ahead of time", name)
+	}
+	proto := v.prototypes[name]
+	if proto == nil {
+		return nil, fmt.Errorf("Function %s does not exist", name)
+	}
+	if hasCValues(proto) {
+		return nil, fmt.Errorf("Function %s cannot be called from Go, it takes or returns pointers or is variadic", name)
+	}
+	arity := len(proto.Args)
+	symbol := v.calleeSymbol(name, arity)
+	if compiled, found := v.entryPoints[symbol]; found {
+		return compiled, nil
+	}
+	if !v.isLinkable(symbol) {
+		return nil, notFoundError(name)
+	}
+	entryFunc := v.defineEntryPoint(name, proto)
+	if err := llvm.VerifyModule(*v.lastModule, llvm.ReturnStatusAction); err != nil {
+		return nil, err
+	}
+	v.switchModule()
+	compiled := &CompiledFunction{name: name, arity: arity, entry: v.jit.FunctionPointer(entryFunc), settings: v.callSettings}
+	v.entryPoints[symbol] = compiled
+	v.tracer.Infof(trace.Codegen, "Entry point of %s compiled as %s", name, entryFunc.Name())
+	return compiled, nil
+}
+
+// defineEntryPoint generates a function loading the arguments from an array
+// then calling the function, so all the functions can be called from C with
+// the same signature. The arguments and the result are converted from and
+// to doubles.
+func (v *VisitorKaleido) defineEntryPoint(name string, prototype *parser.PrototypeAST) llvm.Value {
+	callee := v.declareFunction(name, prototype)
+	doubleType := v.context.DoubleType()
+	entryType := llvm.FunctionType(doubleType, []llvm.Type{llvm.PointerType(doubleType, 0)}, false)
+	entryFunc := llvm.AddFunction(*v.lastModule, callee.Name()+".entry", entryType)
+	v.builder.SetInsertPointAtEnd(v.context.AddBasicBlock(entryFunc, "entry"))
+	args := make([]llvm.Value, len(prototype.Args))
+	for i := range args {
+		index := llvm.ConstInt(v.context.Int64Type(), uint64(i), false)
+		argPtr := v.builder.CreateGEP(entryFunc.Param(0), []llvm.Value{index}, "argptr")
+		argType := prototype.ArgType(i)
+		args[i] = v.toC(v.convert(v.builder.CreateLoad(argPtr, "arg"), parser.TypeDouble, valueType(argType)), argType)
+	}
+	result := v.emitCall(callee, prototype, args)
+	v.builder.CreateRet(v.convert(result, valueType(resultType(prototype)), parser.TypeDouble))
+	return entryFunc
+}
+
+// goCallAddress returns the address of the function called by the adapters
+// of the Go functions.
+func goCallAddress() unsafe.Pointer {
+	return C.kaleido_call_go_address()
+}
+
+// instrumented tells whether the functions compiled from now on must call
+// the runtime at their entry and exit, to be interrupted or limited.
+func (v *VisitorKaleido) instrumented() bool {
+	return v.interruptible || atomic.LoadInt32(&v.callSettings.recursionLimit) > 0
+}
+
+// callRuntime generates a call to a function of the runtime.
+func (v *VisitorKaleido) callRuntime(symbol string, args ...llvm.Value) {
+	runtimeFunc := v.lastModule.NamedFunction(symbol)
+	if runtimeFunc.IsNil() {
+		paramTypes := make([]llvm.Type, 0, len(args))
+		for _, arg := range args {
+			paramTypes = append(paramTypes, arg.Type())
+		}
+		runtimeFunc = llvm.AddFunction(*v.lastModule, symbol, llvm.FunctionType(v.context.VoidType(), paramTypes, false))
+	}
+	v.builder.CreateCall(runtimeFunc, args, "")
+}
@@ -0,0 +1,81 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+)
+
+// ExecutableMainName is the C entry point generated for the executables.
+const ExecutableMainName = "main"
+
+// printSymbol is the function of the runtime library printing the results
+// of the top level expressions of an executable.
+const printSymbol = "printd"
+
+// DefineExecutableMain generates the C main function of an executable
+// compiled ahead of time: it evaluates the top level expressions in order,
+// prints each result with printd from the runtime library, then returns 0.
+// The single module only keeps the last definition of a function and the
+// last value of a global, so a program redefining a function after a top
+// level expression, or assigning a global again, is rejected. The globals
+// of a program are assigned before its functions are compiled, so the order
+// of an assignment and a top level expression is unknown.
+func (v *VisitorKaleido) DefineExecutableMain() error {
+	if v.jit != nil {
+		return errors.New("The entry point of an executable needs a program compiled ahead of time")
+	}
+	if len(v.replaced) != 0 && len(v.topLevelFunctions) != 0 {
+		return fmt.Errorf("%s, the top level expressions of an executable would only see the last version", v.replaced[0])
+	}
+	for _, name := range []string{ExecutableMainName, printSymbol} {
+		if _, defined := v.definitions[name]; defined {
+			return fmt.Errorf("Function %s is defined by the program, an executable needs the one it generates or links", name)
+		}
+	}
+	doubleType := v.context.DoubleType()
+	printType := llvm.FunctionType(doubleType, []llvm.Type{doubleType}, false)
+	printFunc := v.lastModule.NamedFunction(printSymbol)
+	if printFunc.IsNil() {
+		printFunc = llvm.AddFunction(*v.lastModule, printSymbol, printType)
+	} else if printFunc.Type().ElementType() != printType {
+		return fmt.Errorf("Function %s is declared with other types than the one of the runtime library", printSymbol)
+	}
+	mainFunc := llvm.AddFunction(*v.lastModule, ExecutableMainName, llvm.FunctionType(v.context.Int32Type(), nil, false))
+	v.builder.SetInsertPointAtEnd(v.context.AddBasicBlock(mainFunc, "entry"))
+	for _, symbol := range v.topLevelFunctions {
+		result := v.builder.CreateCall(v.lastModule.NamedFunction(symbol), nil, "result")
+		v.builder.CreateCall(printFunc, []llvm.Value{result}, "")
+	}
+	v.builder.CreateRet(llvm.ConstInt(v.context.Int32Type(), 0, false))
+	if err := llvm.VerifyFunction(mainFunc, llvm.ReturnStatusAction); err != nil {
+		mainFunc.EraseFromParentAsFunction()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+)
+
+// ExternPolicy tells whether a program can declare, with extern, the
+// external function with the given name. The JIT resolves such a function
+// against all the symbols of the process, libc included.
+type ExternPolicy func(name string) bool
+
+// MathExterns are functions of the C math library taking and returning
+// doubles, harmless to call from untrusted programs.
+var MathExterns = []string{
+	"acos", "asin", "atan", "atan2", "cbrt", "ceil", "cos", "cosh", "exp",
+	"exp2", "fabs", "floor", "fmax", "fmin", "fmod", "hypot", "log", "log10",
+	"log2", "pow", "round", "sin", "sinh", "sqrt", "tan", "tanh", "trunc",
+}
+
+// AllowExterns returns a policy allowing only the given external functions.
+func AllowExterns(names ...string) ExternPolicy {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return func(name string) bool {
+		return allowed[name]
+	}
+}
+
+// SetExternPolicy restricts the external functions the programs fed from
+// now on can declare, nil allowing all of them.
+func (v *VisitorKaleido) SetExternPolicy(policy ExternPolicy) {
+	v.externPolicy = policy
+}
+
+// checkExterns returns an error naming the external functions declared by
+// the program and not allowed by the policy. The declarations of functions
+// already known, such as the functions defined in Kaleidoscope or linked
+// from a bitcode library, are always allowed. With a policy, the programs
+// cannot load shared libraries themselves: they can only declare externs
+// from the libraries already loaded with LoadLibrary.
+func (v *VisitorKaleido) checkExterns(program *parser.ProgramAST) error {
+	if v.externPolicy == nil {
+		return nil
+	}
+	defined := make(map[string]bool)
+	for i := range program.Funcs {
+		defined[program.Funcs[i].Prototype.FunctionName] = true
+	}
+	denied := []string{}
+	for i := range program.Protos {
+		if library := program.Protos[i].Library; library != "" && !v.isLibraryLoaded(library) {
+			return fmt.Errorf("Library %s not allowed, it must be loaded beforehand", library)
+		}
+		name := program.Protos[i].FunctionName
+		if defined[name] || v.isKnownFunction(name) || v.externPolicy(name) {
+			continue
+		}
+		defined[name] = true
+		denied = append(denied, name)
+	}
+	if len(denied) != 0 {
+		return fmt.Errorf("External functions not allowed: %s", strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// isKnownFunction tells whether a function is defined in Kaleidoscope,
+// linked from a bitcode library or registered from Go. A mere extern
+// declaration does not make a function known.
+func (v *VisitorKaleido) isKnownFunction(name string) bool {
+	if _, found := v.definitions[name]; found {
+		return true
+	}
+	if _, found := v.goFunctions[name]; found {
+		return true
+	}
+	return v.linked[name]
+}
@@ -0,0 +1,249 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
+)
+
+// Global is a variable declared with global or const. The value of a global
+// can be read and changed while the compiled functions run, a constant is
+// folded into the functions using it and cannot change.
+type Global struct {
+	name     string
+	constant bool
+	value    float64
+	// address is the storage of a global in the JIT, allocated out of the
+	// Go heap so the machine code can refer to it.
+	address unsafe.Pointer
+}
+
+// GlobalInfo describes a global or a constant known by the visitor.
+type GlobalInfo struct {
+	Name  string
+	Const bool
+}
+
+// Name returns the name of the variable.
+func (g *Global) Name() string {
+	return g.name
+}
+
+// Const tells if the variable is a constant.
+func (g *Global) Const() bool {
+	return g.constant
+}
+
+// Get returns the current value of the variable.
+func (g *Global) Get() float64 {
+	if g.constant {
+		return g.value
+	}
+	return math.Float64frombits(atomic.LoadUint64((*uint64)(g.address)))
+}
+
+// Set changes the value of a global, seen by the next reads of the running
+// functions. A constant cannot be changed.
+func (g *Global) Set(value float64) error {
+	if g.constant {
+		return fmt.Errorf("Constant %s cannot be changed", g.name)
+	}
+	atomic.StoreUint64((*uint64)(g.address), math.Float64bits(value))
+	return nil
+}
+
+// globalSymbol returns the symbol of the storage of a global. The suffix is
+// a keyword, so it cannot be the name of a private function.
+func globalSymbol(name string) string {
+	return name + ".global"
+}
+
+// Global returns the global or constant with the given name. The globals
+// can only be accessed with the JIT.
+func (v *VisitorKaleido) Global(name string) (*Global, error) {
+	if value, found := v.constants[name]; found {
+		return &Global{name: name, constant: true, value: value}, nil
+	}
+	global, found := v.globals[name]
+	if !found {
+		return nil, fmt.Errorf("Global %s is not defined", name)
+	}
+	if v.jit == nil {
+		return nil, errors.New("No JIT to access the globals, the program is compiled ahead of time")
+	}
+	return global, nil
+}
+
+// Globals lists the known globals and constants, sorted by name.
+func (v *VisitorKaleido) Globals() []GlobalInfo {
+	globals := make([]GlobalInfo, 0, len(v.constants)+len(v.globals))
+	for name := range v.constants {
+		globals = append(globals, GlobalInfo{Name: name, Const: true})
+	}
+	for name := range v.globals {
+		globals = append(globals, GlobalInfo{Name: name})
+	}
+	sort.Slice(globals, func(i, j int) bool {
+		return globals[i].Name < globals[j].Name
+	})
+	return globals
+}
+
+// VisitGlobalAST defines a constant, or a global stored in the JIT or in the
+// module of an ahead of time compilation. Declaring an existing global again
+// changes its value, a constant cannot be redefined with another value as
+// the functions compiled so far use its previous value.
+func (v *VisitorKaleido) VisitGlobalAST(node *parser.GlobalAST) interface{} {
+	v.tracer.Debugf(trace.Codegen, "VisitGlobalAST")
+	value := v.constantValue(node.Name, node.Value)
+	previous, isConstant := v.constants[node.Name]
+	_, isGlobal := v.globals[node.Name]
+	switch {
+	case node.Const && isGlobal:
+		panic(fmt.Sprintf("Global %s cannot be redefined as a constant", node.Name))
+	case !node.Const && isConstant:
+		panic(fmt.Sprintf("Constant %s cannot be redefined as a global", node.Name))
+	case node.Const && isConstant && previous != value && !(math.IsNaN(previous) && math.IsNaN(value)):
+		panic(fmt.Sprintf("Constant %s is already defined with another value", node.Name))
+	case node.Const:
+		v.constants[node.Name] = value
+	case isGlobal:
+		if v.jit == nil {
+			v.replaced = append(v.replaced, "Global "+node.Name+" is assigned again")
+		}
+		v.assignGlobal(node.Name, value)
+	default:
+		v.defineGlobal(node.Name, value)
+	}
+	v.accepted = append(v.accepted, node)
+	v.tracer.Infof(trace.Codegen, "Global %s set to %v", node.Name, value)
+	return nil
+}
+
+// defineGlobal creates a global. With the JIT, the modules only declare it,
+// its storage being mapped by name.
+func (v *VisitorKaleido) defineGlobal(name string, value float64) {
+	global := &Global{name: name}
+	llvmGlobal := v.globalReference(name)
+	if v.jit != nil {
+		global.address = C.calloc(1, C.size_t(unsafe.Sizeof(value)))
+		v.jit.MapGlobal(llvmGlobal, global.address)
+	}
+	v.globals[name] = global
+	v.assignGlobal(name, value)
+}
+
+// assignGlobal sets the value of a global, at run time with the JIT or as
+// the initial value ahead of time.
+func (v *VisitorKaleido) assignGlobal(name string, value float64) {
+	if v.jit != nil {
+		v.globals[name].Set(value)
+		return
+	}
+	v.lastModule.NamedGlobal(globalSymbol(name)).SetInitializer(llvm.ConstFloat(v.context.DoubleType(), value))
+}
+
+// globalReference returns the storage of a global in the current module,
+// declaring it when needed.
+func (v *VisitorKaleido) globalReference(name string) llvm.Value {
+	symbol := globalSymbol(name)
+	llvmGlobal := v.lastModule.NamedGlobal(symbol)
+	if llvmGlobal.IsNil() {
+		llvmGlobal = llvm.AddGlobal(*v.lastModule, v.context.DoubleType(), symbol)
+		llvmGlobal.SetLinkage(llvm.ExternalLinkage)
+		llvmGlobal.SetAlignment(8)
+	}
+	return llvmGlobal
+}
+
+// loadGlobal reads a global. The load is atomic, as the value may be changed
+// from Go while the function runs.
+func (v *VisitorKaleido) loadGlobal(name string) llvm.Value {
+	value := v.builder.CreateLoad(v.globalReference(name), name)
+	value.SetOrdering(llvm.AtomicOrderingMonotonic)
+	value.SetAlignment(8)
+	return value
+}
+
+// constantValue evaluates at compile time the value of a global or a
+// constant, which may only use numbers, operators and constants.
+func (v *VisitorKaleido) constantValue(name string, expr parser.ExprAST) float64 {
+	switch node := expr.(type) {
+	case parser.NumberExprAST:
+		value, err := strconv.ParseFloat(node.Value, 64)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid number %s in the value of %s", node.Value, name))
+		}
+		return value
+	case parser.VariableExprAST:
+		if value, found := v.constants[string(node)]; found {
+			return value
+		}
+		panic(fmt.Sprintf("The value of %s can only use constants, not %s", name, string(node)))
+	case *parser.BinaryExprAST:
+		lhs, rhs := v.constantValue(name, node.LHS), v.constantValue(name, node.RHS)
+		switch node.Op {
+		case '+':
+			return lhs + rhs
+		case '-':
+			return lhs - rhs
+		case '*':
+			return lhs * rhs
+		case '<':
+			// Unordered comparison, as generated for the functions.
+			if !(lhs >= rhs) {
+				return 1
+			}
+			return 0
+		}
+		panic(fmt.Sprintf("Unknown operator: %v", node.Op))
+	}
+	panic(fmt.Sprintf("The value of %s must be a constant expression", name))
+}
+
+// freeGlobals releases the storage of the globals of the JIT.
+func (v *VisitorKaleido) freeGlobals() {
+	for _, global := range v.globals {
+		if global.address != nil {
+			C.free(global.address)
+			global.address = nil
+		}
+	}
+}
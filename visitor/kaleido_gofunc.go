@@ -0,0 +1,213 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+/*
+#include <stddef.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
+)
+
+// goFunction is a Go function callable from Kaleidoscope. The JIT calls an
+// adapter generated for it, which gives its arguments and its id to
+// kaleidoGoFunction.
+type goFunction struct {
+	id    int64
+	name  string
+	arity int
+	call  func(args []float64) float64
+}
+
+// goFunctions are the Go functions registered by all the visitors, by id.
+var goFunctions = struct {
+	sync.RWMutex
+	byID   map[int64]*goFunction
+	nextID int64
+	// failures are the errors of the Go functions, by call state.
+	failures map[uintptr]error
+}{byID: make(map[int64]*goFunction), failures: make(map[uintptr]error)}
+
+//export kaleidoGoFunction
+func kaleidoGoFunction(id C.longlong, args *C.double, state unsafe.Pointer, failed *C.int) (result C.double) {
+	goFunctions.RLock()
+	function := goFunctions.byID[int64(id)]
+	goFunctions.RUnlock()
+	defer func() {
+		if r := recover(); r != nil {
+			// A panic cannot unwind through the generated code, the call is
+			// stopped by the caller once back in C.
+			goFunctions.Lock()
+			goFunctions.failures[uintptr(state)] = fmt.Errorf("Go function %s failed: %v", function.name, r)
+			goFunctions.Unlock()
+			*failed = 1
+		}
+	}()
+	var argSlice []float64
+	if function.arity != 0 {
+		argSlice = (*[1 << 20]float64)(unsafe.Pointer(args))[:function.arity:function.arity]
+	}
+	return C.double(function.call(argSlice))
+}
+
+// goFunctionError returns the error of the Go function which failed during
+// the call with the given state.
+func goFunctionError(state unsafe.Pointer) error {
+	goFunctions.Lock()
+	defer goFunctions.Unlock()
+	err := goFunctions.failures[uintptr(state)]
+	delete(goFunctions.failures, uintptr(state))
+	return err
+}
+
+func goCallType(context llvm.Context) llvm.Type {
+	paramTypes := []llvm.Type{context.Int64Type(), llvm.PointerType(context.DoubleType(), 0)}
+	return llvm.FunctionType(context.DoubleType(), paramTypes, false)
+}
+
+var float64Type = reflect.TypeOf(float64(0))
+
+// wrapGoFunction returns a function of its arguments as a slice calling
+// fn, which must take float64 arguments and return a single float64.
+func wrapGoFunction(fn interface{}) (func(args []float64) float64, int, error) {
+	switch f := fn.(type) {
+	case func() float64:
+		return func([]float64) float64 { return f() }, 0, nil
+	case func(float64) float64:
+		return func(args []float64) float64 { return f(args[0]) }, 1, nil
+	case func(float64, float64) float64:
+		return func(args []float64) float64 { return f(args[0], args[1]) }, 2, nil
+	case func(float64, float64, float64) float64:
+		return func(args []float64) float64 { return f(args[0], args[1], args[2]) }, 3, nil
+	}
+	value := reflect.ValueOf(fn)
+	fnType := value.Type()
+	if fnType.Kind() != reflect.Func || fnType.IsVariadic() || fnType.NumOut() != 1 || fnType.Out(0) != float64Type {
+		return nil, 0, fmt.Errorf("%s is not a function of float64 arguments returning a float64", fnType)
+	}
+	for i := 0; i < fnType.NumIn(); i++ {
+		if fnType.In(i) != float64Type {
+			return nil, 0, fmt.Errorf("%s is not a function of float64 arguments returning a float64", fnType)
+		}
+	}
+	call := func(args []float64) float64 {
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			in[i] = reflect.ValueOf(arg)
+		}
+		return value.Call(in)[0].Float()
+	}
+	return call, fnType.NumIn(), nil
+}
+
+// RegisterFunc makes a Go function callable from Kaleidoscope under the
+// given name, directly or once declared with extern. fn must take float64
+// arguments and return a float64, for instance func(a, b float64) float64.
+// Registering the name again replaces the function, keeping its number of
+// arguments. fn may be called from several goroutines at once, and a panic
+// stops the call with an error.
+func (v *VisitorKaleido) RegisterFunc(name string, fn interface{}) error {
+	if v.jit == nil {
+		return errors.New("Go functions can only be called by the JIT")
+	}
+	call, arity, err := wrapGoFunction(fn)
+	if err != nil {
+		return err
+	}
+	if function, found := v.goFunctions[name]; found {
+		if function.arity != arity {
+			return fmt.Errorf("Go function %s takes %d arguments, not %d", name, function.arity, arity)
+		}
+		goFunctions.Lock()
+		goFunctions.byID[function.id] = &goFunction{id: function.id, name: name, arity: arity, call: call}
+		goFunctions.Unlock()
+		return nil
+	}
+	if v.prototypes[name] != nil || name == parser.MainFunctionName {
+		return fmt.Errorf("Function %s is already declared", name)
+	}
+	goFunctions.Lock()
+	goFunctions.nextID++
+	function := &goFunction{id: goFunctions.nextID, name: name, arity: arity, call: call}
+	goFunctions.byID[function.id] = function
+	goFunctions.Unlock()
+	prototype := resolveDeclaration(&parser.PrototypeAST{FunctionName: name, Args: goFunctionArgs(arity)}, false)
+	v.defineGoAdapter(function, prototype)
+	v.switchModule()
+	v.goFunctions[name] = function
+	v.prototypes[name] = prototype
+	v.tracer.Infof(trace.Codegen, "Go function %s registered", name)
+	return nil
+}
+
+func goFunctionArgs(arity int) []string {
+	args := make([]string, arity)
+	for i := range args {
+		args[i] = fmt.Sprintf("x%d", i)
+	}
+	return args
+}
+
+// defineGoAdapter generates the function called from Kaleidoscope, which
+// stores its arguments in an array then calls the Go function.
+func (v *VisitorKaleido) defineGoAdapter(function *goFunction, prototype *parser.PrototypeAST) {
+	adapter := llvm.AddFunction(*v.lastModule, function.name, v.functionType(prototype))
+	v.builder.SetInsertPointAtEnd(v.context.AddBasicBlock(adapter, "entry"))
+	doubleType := v.context.DoubleType()
+	argsPtr := llvm.ConstPointerNull(llvm.PointerType(doubleType, 0))
+	if function.arity != 0 {
+		args := v.builder.CreateArrayAlloca(doubleType, llvm.ConstInt(v.context.Int64Type(), uint64(function.arity), false), "args")
+		for i, param := range adapter.Params() {
+			index := llvm.ConstInt(v.context.Int64Type(), uint64(i), false)
+			v.builder.CreateStore(param, v.builder.CreateGEP(args, []llvm.Value{index}, "argptr"))
+		}
+		argsPtr = args
+	}
+	goCall := v.lastModule.NamedFunction(goCallSymbol)
+	if goCall.IsNil() {
+		goCall = llvm.AddFunction(*v.lastModule, goCallSymbol, goCallType(*v.context))
+	}
+	id := llvm.ConstInt(v.context.Int64Type(), uint64(function.id), false)
+	v.builder.CreateRet(v.builder.CreateCall(goCall, []llvm.Value{id, argsPtr}, "result"))
+}
+
+// unregisterGoFunctions forgets the Go functions of the visitor.
+func (v *VisitorKaleido) unregisterGoFunctions() {
+	goFunctions.Lock()
+	defer goFunctions.Unlock()
+	for _, function := range v.goFunctions {
+		delete(goFunctions.byID, function.id)
+	}
+}
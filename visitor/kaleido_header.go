@@ -0,0 +1,125 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+)
+
+// ExportedFunctions lists the functions of an ahead of time compilation
+// which can be called from C, sorted by name: the functions defined by the
+// program, except the private ones and the top level expressions.
+func (v *VisitorKaleido) ExportedFunctions() ([]FunctionInfo, error) {
+	if v.jit != nil {
+		return nil, errors.New("The functions are only exported by a program compiled ahead of time")
+	}
+	exported := []FunctionInfo{}
+	for _, function := range v.Functions() {
+		definition, defined := v.definitions[function.Name]
+		if !defined || function.Name == parser.MainFunctionName || definition.Linkage() != llvm.ExternalLinkage {
+			continue
+		}
+		exported = append(exported, function)
+	}
+	return exported, nil
+}
+
+// CDeclaration returns the C declaration of a function, as in
+// double f(double, double); The int values are int64_t and the bool values
+// bool, from stdint.h and stdbool.h.
+func CDeclaration(function FunctionInfo) string {
+	params := make([]string, 0, len(function.ArgTypes))
+	for _, argType := range function.ArgTypes {
+		params = append(params, cType(argType))
+	}
+	if len(params) == 0 {
+		params = append(params, "void")
+	}
+	result := cType(function.ReturnType)
+	if !strings.HasSuffix(result, "*") {
+		result += " "
+	}
+	return fmt.Sprintf("%s%s(%s);", result, function.Name, strings.Join(params, ", "))
+}
+
+// cType returns the C type of a Kaleidoscope type.
+func cType(t parser.Type) string {
+	switch t {
+	case parser.TypeInt:
+		return "int64_t"
+	case parser.TypeBool:
+		return "bool"
+	case parser.TypePtr:
+		return "void *"
+	}
+	return "double"
+}
+
+// reservedCNames are the keywords of C and C++ and the names of common
+// functions of the C library, which an exported function cannot take: the
+// header would not compile, or the function would replace the one of the
+// C library in the programs loading it.
+var reservedCNames = map[string]bool{}
+
+func init() {
+	for _, names := range [][]string{
+		{
+			"alignas", "alignof", "and", "asm", "auto", "bool", "break", "case",
+			"catch", "char", "class", "const", "constexpr", "continue",
+			"decltype", "default", "delete", "do", "double", "else", "enum",
+			"explicit", "export", "extern", "false", "float", "for", "friend",
+			"goto", "if", "inline", "int", "long", "mutable", "namespace", "new",
+			"noexcept", "not", "nullptr", "operator", "or", "private",
+			"protected", "public", "register", "restrict", "return", "short",
+			"signed", "sizeof", "static", "struct", "switch", "template", "this",
+			"throw", "true", "try", "typedef", "typeid", "typename", "union",
+			"unsigned", "using", "virtual", "void", "volatile", "while", "xor",
+		},
+		{
+			"abort", "abs", "atexit", "atof", "atoi", "calloc", "exit", "fclose",
+			"fflush", "fopen", "fprintf", "fputs", "free", "fwrite", "getchar",
+			"getenv", "labs", "main", "malloc", "memcmp", "memcpy", "memmove",
+			"memset", "printf", "putchar", "puts", "qsort", "rand", "realloc",
+			"signal", "snprintf", "sprintf", "srand", "strcmp", "strcpy",
+			"strlen", "strncmp", "system", "time",
+		},
+		MathExterns,
+	} {
+		for _, name := range names {
+			reservedCNames[name] = true
+		}
+	}
+}
+
+// IsReservedCName tells whether a function cannot be exported with its name,
+// being a keyword of C or C++ or a function of the C library.
+func IsReservedCName(name string) bool {
+	return reservedCNames[name]
+}
@@ -1,13 +1,19 @@
 package visitor
 
 import (
-	"errors"
+	"unsafe"
 
 	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/kaleidort"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
 )
 
 type KaleidoscopeJIT struct {
 	executionEngine llvm.ExecutionEngine
+	tracer          *trace.Tracer
+	// mapped are the names mapped to an address instead of being looked up
+	// in the process.
+	mapped map[string]bool
 }
 
 func init() {
@@ -15,31 +21,83 @@ func init() {
 	llvm.InitializeNativeAsmPrinter()
 }
 
-func NewKaleidoJIT(module *llvm.Module) KaleidoscopeJIT {
+// NewKaleidoJIT returns a JIT whose modules belong to the given context. The
+// functions of the runtime library are mapped, so they are found by name
+// whatever the symbols of the process, as well as the function calling the
+// Go functions.
+func NewKaleidoJIT(context llvm.Context) KaleidoscopeJIT {
+	module := context.NewModule("runtime")
+	runtimeFunctions := kaleidort.Functions()
+	declarations := make([]llvm.Value, 0, len(runtimeFunctions))
+	for _, function := range runtimeFunctions {
+		paramTypes := make([]llvm.Type, function.Arity)
+		for i := range paramTypes {
+			paramTypes[i] = context.DoubleType()
+		}
+		functionType := llvm.FunctionType(context.DoubleType(), paramTypes, false)
+		declarations = append(declarations, llvm.AddFunction(module, function.Name, functionType))
+	}
+	goCall := llvm.AddFunction(module, goCallSymbol, goCallType(context))
 	compilerOptions := llvm.NewMCJITCompilerOptions()
-	executionEngine, err := llvm.NewMCJITCompiler(*module, compilerOptions)
+	executionEngine, err := llvm.NewMCJITCompiler(module, compilerOptions)
 	if err != nil {
 		panic(err)
 	}
-	return KaleidoscopeJIT{executionEngine}
+	mapped := map[string]bool{goCallSymbol: true}
+	for i, function := range runtimeFunctions {
+		executionEngine.AddGlobalMapping(declarations[i], function.Address)
+		mapped[function.Name] = true
+	}
+	executionEngine.AddGlobalMapping(goCall, goCallAddress())
+	return KaleidoscopeJIT{executionEngine: executionEngine, mapped: mapped}
+}
+
+// Dispose releases the JIT and the modules added to it.
+func (j *KaleidoscopeJIT) Dispose() {
+	j.executionEngine.Dispose()
 }
 
 func (j *KaleidoscopeJIT) AddModule(module llvm.Module) {
+	j.tracer.Debugf(trace.JIT, "Adding module")
 	j.executionEngine.AddModule(module)
 }
 
-func (j *KaleidoscopeJIT) Run(name string, args ...float64) (float64, error) {
-	f := j.executionEngine.FindFunction(name)
-	if f.IsNil() {
-		return 0, errors.New("Function " + name + " does not exist")
-	}
-	if f.ParamsCount() != len(args) {
-		return 0, errors.New("Bad number of arguments")
+// RemoveModule removes a module which is not used anymore, and releases it.
+// Its machine code is kept until the JIT is disposed.
+func (j *KaleidoscopeJIT) RemoveModule(module llvm.Module) {
+	j.tracer.Debugf(trace.JIT, "Removing module")
+	j.executionEngine.RemoveModule(module)
+	module.Dispose()
+}
+
+// FunctionPointer returns the address of the machine code of a function.
+func (j *KaleidoscopeJIT) FunctionPointer(f llvm.Value) unsafe.Pointer {
+	return j.executionEngine.PointerToGlobal(f)
+}
+
+// MapGlobal makes the global with the name of the given one, in all the
+// modules, refer to the storage at address.
+func (j *KaleidoscopeJIT) MapGlobal(global llvm.Value, address unsafe.Pointer) {
+	j.executionEngine.AddGlobalMapping(global, address)
+	j.mapped[global.Name()] = true
+}
+
+// HasSymbol tells if a function called by name can be linked: it is mapped,
+// defined by a module of the JIT, or found in the process and the shared
+// libraries loaded.
+func (j *KaleidoscopeJIT) HasSymbol(name string) bool {
+	if j.mapped[name] {
+		return true
 	}
-	genericValues := make([]llvm.GenericValue, f.ParamsCount())
-	for _, arg := range args {
-		genericValues = append(genericValues, llvm.NewGenericValueFromFloat(llvm.DoubleType(), arg))
+	if function := j.executionEngine.FindFunction(name); !function.IsNil() && !function.IsDeclaration() {
+		return true
 	}
-	result := j.executionEngine.RunFunction(f, genericValues)
-	return result.Float(llvm.DoubleType()), nil
+	return searchSymbol(name)
+}
+
+// RunInitializer runs a function without argument nor result, used to
+// initialize the state of the JIT.
+func (j *KaleidoscopeJIT) RunInitializer(f llvm.Value) {
+	j.tracer.Debugf(trace.JIT, "Running initializer %s", f.Name())
+	j.executionEngine.RunFunction(f, []llvm.GenericValue{}).Dispose()
 }
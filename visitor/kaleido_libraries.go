@@ -0,0 +1,105 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+/*
+#include "llvm-c/Support.h"
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
+)
+
+// LoadLibrary loads a shared library, such as libm.so.6, whose functions can
+// then be declared as externs. The library is searched as by dlopen, and
+// stays loaded for the whole process: its symbols are visible to all the
+// visitors. Loading a library runs its initialization code, so only trusted
+// libraries must be loaded.
+func (v *VisitorKaleido) LoadLibrary(path string) error {
+	if v.isLibraryLoaded(path) {
+		return nil
+	}
+	if err := llvm.LoadLibraryPermanently(path); err != nil {
+		return fmt.Errorf("Cannot load library %s: %w", path, err)
+	}
+	v.libraries = append(v.libraries, path)
+	v.tracer.Infof(trace.JIT, "Library %s loaded", path)
+	return nil
+}
+
+// Libraries returns the shared libraries loaded, in their loading order.
+func (v *VisitorKaleido) Libraries() []string {
+	return append([]string(nil), v.libraries...)
+}
+
+func (v *VisitorKaleido) isLibraryLoaded(path string) bool {
+	for _, loaded := range v.libraries {
+		if loaded == path {
+			return true
+		}
+	}
+	return false
+}
+
+// searchSymbol tells if a symbol is found in the process or in the shared
+// libraries loaded.
+func searchSymbol(name string) bool {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return C.LLVMSearchForAddressOfSymbol(cname) != nil
+}
+
+// checkLinked stops the compilation when a function called cannot be linked
+// by the JIT, which would otherwise abort the process once the code runs.
+func (v *VisitorKaleido) checkLinked(symbols []string) {
+	for _, symbol := range symbols {
+		if !v.isLinkable(symbol) {
+			panic(notFoundError(symbol))
+		}
+	}
+}
+
+// notFoundError reports a function which is neither defined nor found by
+// the JIT in the process or in the libraries loaded.
+func notFoundError(name string) error {
+	return fmt.Errorf("Function %s not found: it is neither defined nor a symbol of the process or of the libraries loaded", name)
+}
+
+func (v *VisitorKaleido) isLinkable(symbol string) bool {
+	for _, stubs := range v.stubs {
+		for _, stub := range stubs {
+			if stub.symbol == symbol {
+				return true
+			}
+		}
+	}
+	return v.jit.HasSymbol(symbol)
+}
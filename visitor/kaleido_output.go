@@ -0,0 +1,80 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+/*
+#include <stddef.h>
+*/
+import "C"
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// outputWriter serializes the writes of the concurrent calls to a writer.
+type outputWriter struct {
+	sync.Mutex
+	writer io.Writer
+}
+
+// outputs are the writers of the output of all the visitors, by id.
+var outputs = struct {
+	sync.RWMutex
+	byID   map[int64]*outputWriter
+	nextID int64
+}{byID: make(map[int64]*outputWriter)}
+
+//export kaleidoWriteOutput
+func kaleidoWriteOutput(output C.longlong, data *C.char, size C.size_t) {
+	outputs.RLock()
+	writer := outputs.byID[int64(output)]
+	outputs.RUnlock()
+	if writer == nil {
+		return
+	}
+	writer.Lock()
+	defer writer.Unlock()
+	// As with the standard output, a failed write is ignored.
+	writer.writer.Write(C.GoBytes(unsafe.Pointer(data), C.int(size)))
+}
+
+// SetOutput makes the functions of the runtime library, such as putchard or
+// printd, write to the given writer during the calls from Go. Nil restores
+// the standard output of the process.
+func (v *VisitorKaleido) SetOutput(writer io.Writer) {
+	outputs.Lock()
+	defer outputs.Unlock()
+	delete(outputs.byID, atomic.LoadInt64(&v.callSettings.output))
+	id := int64(0)
+	if writer != nil {
+		outputs.nextID++
+		id = outputs.nextID
+		outputs.byID[id] = &outputWriter{writer: writer}
+	}
+	atomic.StoreInt64(&v.callSettings.output, id)
+}
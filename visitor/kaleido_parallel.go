@@ -0,0 +1,311 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
+)
+
+// compileJob is a function of a program compiled by a worker of a parallel
+// compilation.
+type compileJob struct {
+	node     *parser.FunctionAST
+	name     string
+	symbol   string
+	cacheKey string
+	cached   bool
+	bitcode  []byte
+	err      error
+}
+
+// compileWorker compiles functions in its own context.
+type compileWorker struct {
+	visitor    VisitorKaleido
+	dataLayout string
+	target     string
+}
+
+// SetWorkers sets the number of goroutines compiling the functions of a
+// program in parallel. With 1 or less, functions are compiled sequentially.
+func (v *VisitorKaleido) SetWorkers(workers int) {
+	v.workers = workers
+}
+
+// feedParallel compiles the functions of a program with several workers,
+// each owning its context, builder, modules and pass manager. The results
+// are merged in the order of the program, so the generated code does not
+// depend on the number of workers. The functions which cannot be compiled
+// independently from the previous ones, such as a second definition of the
+// same function, are compiled sequentially once the others are merged.
+func (v *VisitorKaleido) feedParallel(program *parser.ProgramAST) {
+	for i := range program.Globals {
+		program.Globals[i].Accept(v)
+	}
+	for i := range program.Protos {
+		program.Protos[i].Accept(v)
+	}
+	jobs, view := v.planJobs(program.Funcs)
+	if len(jobs) < 2 {
+		jobs = nil
+	} else {
+		v.runJobs(jobs, view)
+		v.mergeJobs(jobs)
+	}
+	for i := len(jobs); i < len(program.Funcs); i++ {
+		program.Funcs[i].Accept(v)
+	}
+}
+
+// planJobs returns the jobs for the longest sequence of functions which can
+// be compiled in parallel, and a view of the visitor knowing their
+// prototypes and stubs, to be used by the workers.
+func (v *VisitorKaleido) planJobs(functions []parser.FunctionAST) ([]*compileJob, *VisitorKaleido) {
+	view := *v
+	view.prototypes = make(map[string]*parser.PrototypeAST, len(v.prototypes))
+	for name, prototype := range v.prototypes {
+		view.prototypes[name] = prototype
+	}
+	view.stubs = make(map[string]map[int]*functionStub, len(v.stubs))
+	for name, stubs := range v.stubs {
+		view.stubs[name] = stubs
+	}
+	view.dependencies = make(map[string][]string, len(v.dependencies))
+	for name, callees := range v.dependencies {
+		view.dependencies[name] = callees
+	}
+	jobs := []*compileJob{}
+	planned := make(map[string]bool)
+	for i := range functions {
+		node := &functions[i]
+		file, arity := node.Prototype.File, len(node.Prototype.Args)
+		if file != "" {
+			// Workers must find the prefix of the file without adding it.
+			v.unitPrefix(file)
+		}
+		name := node.Prototype.FunctionName
+		if node.Private {
+			name = v.privateName(file, name)
+		}
+		if planned[name] {
+			break
+		}
+		symbol := fmt.Sprintf("%s.%d", name, v.versions[name]+1)
+		if v.jit == nil {
+			symbol = name
+			if name == parser.MainFunctionName {
+				symbol = fmt.Sprintf("%s.%d", name, len(v.topLevelFunctions)+1)
+			}
+			previousFunc := v.lastModule.NamedFunction(symbol)
+			if !previousFunc.IsNil() && (!previousFunc.IsDeclaration() || previousFunc.ParamsCount() != arity) {
+				break
+			}
+		}
+		previousProto := view.prototypes[name]
+		view.prototypes[name] = &node.Prototype
+		view.currentFile = file
+		if !view.callsKnownFunctions(node) {
+			view.restorePrototype(name, previousProto)
+			break
+		}
+		prototype, err := view.checkedPrototype(node, name)
+		if err != nil || (v.jit == nil && previousProto != nil && !sameSignature(previousProto, prototype)) {
+			// Reported when compiled sequentially.
+			view.restorePrototype(name, previousProto)
+			break
+		}
+		view.prototypes[name] = prototype
+		if stub, isNewStub := view.stubFor(name, prototype); isNewStub && v.jit != nil {
+			stubs := make(map[int]*functionStub, len(view.stubs[name])+1)
+			for stubArity, existing := range view.stubs[name] {
+				stubs[stubArity] = existing
+			}
+			stubs[arity] = stub
+			view.stubs[name] = stubs
+		}
+		job := &compileJob{node: node, name: name, symbol: symbol}
+		if v.jit != nil {
+			job.cacheKey = view.cacheKey(node, name)
+			job.cached = job.cacheKey != "" && v.cache.lookup(job.cacheKey)
+		}
+		view.dependencies[name] = view.calleeNames(node.Body)
+		planned[name] = true
+		jobs = append(jobs, job)
+	}
+	return jobs, &view
+}
+
+// checkedPrototype returns the prototype of a function with its types, or
+// the error of the type checking.
+func (v *VisitorKaleido) checkedPrototype(node *parser.FunctionAST, name string) (prototype *parser.PrototypeAST, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(r)
+		}
+	}()
+	prototype = v.resolvePrototype(node, name)
+	if stub, found := v.stubs[name][len(prototype.Args)]; found && !sameSignature(stub.prototype, prototype) {
+		return nil, fmt.Errorf("Function %s cannot change its types", name)
+	}
+	return prototype, nil
+}
+
+// callsKnownFunctions tells if the functions called by a function are known,
+// with the right number of arguments.
+func (v *VisitorKaleido) callsKnownFunctions(node *parser.FunctionAST) bool {
+	for _, call := range v.collectCalls(node.Body) {
+		prototype, found := v.prototypes[v.resolveFunction(call.FunctionName)]
+		if !found || !acceptsArgs(prototype, len(call.Args)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *VisitorKaleido) runJobs(jobs []*compileJob, view *VisitorKaleido) {
+	queue := make(chan *compileJob)
+	var group sync.WaitGroup
+	for i := 0; i < v.workers && i < len(jobs); i++ {
+		worker := view.newWorker()
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			defer worker.dispose()
+			for job := range queue {
+				worker.compile(job)
+			}
+		}()
+	}
+	compiled := 0
+	for _, job := range jobs {
+		if !job.cached {
+			queue <- job
+			compiled++
+		}
+	}
+	close(queue)
+	group.Wait()
+	v.tracer.Infof(trace.Codegen, "%d functions compiled by %d workers", compiled, v.workers)
+}
+
+// newWorker returns a worker sharing the view of the functions, with its
+// own context and builder.
+func (v *VisitorKaleido) newWorker() *compileWorker {
+	context := llvm.NewContext()
+	builder := context.NewBuilder()
+	worker := &compileWorker{visitor: *v, dataLayout: v.lastModule.DataLayout(), target: v.lastModule.Target()}
+	worker.visitor.context = &context
+	worker.visitor.builder = &builder
+	worker.visitor.jit = nil
+	worker.visitor.cache = nil
+	worker.visitor.passObserver = nil
+	return worker
+}
+
+func (w *compileWorker) dispose() {
+	w.visitor.builder.Dispose()
+	w.visitor.context.Dispose()
+}
+
+// compile generates and optimizes a function in its own module, and keeps
+// its bitcode in the job.
+func (w *compileWorker) compile(job *compileJob) {
+	v := &w.visitor
+	module, passManager, modulePassManager := newModuleAndPassManagers(*v.context, v.optimization)
+	defer module.Dispose()
+	defer passManager.Dispose()
+	modulePassManager.Dispose()
+	module.SetDataLayout(w.dataLayout)
+	module.SetTarget(w.target)
+	v.lastModule = module
+	v.lastPassManager = passManager
+	v.currentFile = job.node.Prototype.File
+	defer func() {
+		if r := recover(); r != nil {
+			job.err = recoveredError(r)
+		}
+	}()
+	llvmFunc := llvm.AddFunction(*module, job.symbol, v.functionType(v.prototypes[job.name]))
+	v.emitFunctionBody(llvmFunc, job.node, job.name)
+	job.bitcode = writeBitcode(*module)
+}
+
+// mergeJobs defines the functions compiled by the workers, in order.
+func (v *VisitorKaleido) mergeJobs(jobs []*compileJob) {
+	merged := 0
+	defer func() {
+		if v.jit != nil {
+			return
+		}
+		// Internal functions would not be resolved while linking the
+		// next functions, they are only made internal once all linked.
+		for _, job := range jobs[:merged] {
+			if job.node.Private || job.name == parser.MainFunctionName {
+				v.lastModule.NamedFunction(job.symbol).SetLinkage(llvm.InternalLinkage)
+			}
+		}
+	}()
+	for _, job := range jobs {
+		v.mergeJob(job)
+		merged++
+	}
+}
+
+// mergeJob defines in the visitor a function compiled by a worker.
+func (v *VisitorKaleido) mergeJob(job *compileJob) {
+	if job.err != nil {
+		panic(job.err)
+	}
+	v.currentFile = job.node.Prototype.File
+	if job.cached {
+		module, err := v.cache.load(job.cacheKey, *v.context)
+		if err != nil {
+			// Compiled again, as for any broken cache entry.
+			v.defineWithStub(job.node, job.name, nil)
+			return
+		}
+		v.tracer.Infof(trace.Codegen, "Function %s loaded from the compilation cache", job.name)
+		v.defineWithStub(job.node, job.name, &module)
+		return
+	}
+	module, err := parseBitcode(*v.context, job.bitcode)
+	if err != nil {
+		panic(err)
+	}
+	if job.cacheKey != "" {
+		if err := v.cache.store(job.cacheKey, module); err != nil {
+			v.tracer.Infof(trace.Codegen, "Cannot write the compilation cache: %v", err)
+		}
+	}
+	if v.jit == nil {
+		v.defineInModule(job.node, job.name, &module)
+	} else {
+		v.defineWithStub(job.node, job.name, &module)
+	}
+}
@@ -0,0 +1,296 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+/*
+#include "llvm-c/Core.h"
+#include "llvm-c/Transforms/Scalar.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+)
+
+// OptimizationConfig selects the passes run on each compiled module.
+type OptimizationConfig struct {
+	// Level is the optimization level, from 0 to 3 as -O0 to -O3.
+	Level int
+	// SizeLevel favors the code size, 1 as -Os and 2 as -Oz.
+	SizeLevel int
+	// Passes, when not empty, names the passes to run instead of the
+	// pipeline built from the levels.
+	Passes []string
+}
+
+// DefaultOptimization is the pipeline of the LLVM tutorial, cheap enough to
+// keep the REPL responsive.
+var DefaultOptimization = OptimizationConfig{Passes: []string{"instcombine", "reassociate", "gvn", "simplifycfg"}}
+
+// NoOptimization runs no pass at all.
+var NoOptimization = OptimizationConfig{Passes: []string{}}
+
+// PassStage is the state of a function after one step of its optimization.
+type PassStage struct {
+	Pass             string
+	IR               string
+	InstructionCount int
+}
+
+// PassObserver receives the successive stages of the optimization of a
+// function, the first one being the unoptimized function.
+type PassObserver func(function string, stages []PassStage)
+
+type namedPass struct {
+	isModulePass bool
+	add          func(llvm.PassManager)
+}
+
+var namedPasses = map[string]namedPass{
+	"adce":                  {false, llvm.PassManager.AddAggressiveDCEPass},
+	"dse":                   {false, llvm.PassManager.AddDeadStoreEliminationPass},
+	"early-cse":             {false, addEarlyCSEPass},
+	"gvn":                   {false, llvm.PassManager.AddGVNPass},
+	"indvars":               {false, llvm.PassManager.AddIndVarSimplifyPass},
+	"instcombine":           {false, llvm.PassManager.AddInstructionCombiningPass},
+	"jump-threading":        {false, llvm.PassManager.AddJumpThreadingPass},
+	"licm":                  {false, llvm.PassManager.AddLICMPass},
+	"loop-deletion":         {false, llvm.PassManager.AddLoopDeletionPass},
+	"loop-rotate":           {false, llvm.PassManager.AddLoopRotatePass},
+	"loop-unroll":           {false, llvm.PassManager.AddLoopUnrollPass},
+	"lower-expect":          {false, addLowerExpectIntrinsicPass},
+	"mem2reg":               {false, llvm.PassManager.AddPromoteMemoryToRegisterPass},
+	"memcpyopt":             {false, llvm.PassManager.AddMemCpyOptPass},
+	"reassociate":           {false, llvm.PassManager.AddReassociatePass},
+	"sccp":                  {false, llvm.PassManager.AddSCCPPass},
+	"simplifycfg":           {false, llvm.PassManager.AddCFGSimplificationPass},
+	"sroa":                  {false, llvm.PassManager.AddScalarReplAggregatesPass},
+	"tailcallelim":          {false, llvm.PassManager.AddTailCallEliminationPass},
+	"argpromotion":          {true, llvm.PassManager.AddArgumentPromotionPass},
+	"constmerge":            {true, llvm.PassManager.AddConstantMergePass},
+	"deadargelim":           {true, llvm.PassManager.AddDeadArgEliminationPass},
+	"function-attrs":        {true, llvm.PassManager.AddFunctionAttrsPass},
+	"globaldce":             {true, llvm.PassManager.AddGlobalDCEPass},
+	"globalopt":             {true, llvm.PassManager.AddGlobalOptimizerPass},
+	"inline":                {true, llvm.PassManager.AddFunctionInliningPass},
+	"ipsccp":                {true, llvm.PassManager.AddIPSCCPPass},
+	"strip-dead-prototypes": {true, llvm.PassManager.AddStripDeadPrototypesPass},
+}
+
+// The bindings miss some of the passes of the C API.
+
+func addEarlyCSEPass(pm llvm.PassManager) {
+	C.LLVMAddEarlyCSEPass(C.LLVMPassManagerRef(unsafe.Pointer(pm.C)))
+}
+
+func addLowerExpectIntrinsicPass(pm llvm.PassManager) {
+	C.LLVMAddLowerExpectIntrinsicPass(C.LLVMPassManagerRef(unsafe.Pointer(pm.C)))
+}
+
+// cloneModule returns a copy of a module, in the same context.
+func cloneModule(module llvm.Module) llvm.Module {
+	clone := C.LLVMCloneModule(C.LLVMModuleRef(unsafe.Pointer(module.C)))
+	// llvm.Module only wraps the module reference.
+	return *(*llvm.Module)(unsafe.Pointer(&clone))
+}
+
+// levelFunctionPasses are the function passes of the pipelines built from
+// the levels, from -O1, as populated by the pass manager builder of LLVM.
+var levelFunctionPasses = []string{"lower-expect", "simplifycfg", "sroa", "early-cse"}
+
+// functionPasses returns the function passes of a configuration, in order.
+func functionPasses(config OptimizationConfig) []string {
+	if config.Passes == nil {
+		if config.Level == 0 {
+			return nil
+		}
+		return levelFunctionPasses
+	}
+	passes := []string{}
+	for _, name := range config.Passes {
+		if !namedPasses[name].isModulePass {
+			passes = append(passes, name)
+		}
+	}
+	return passes
+}
+
+// addModulePasses adds the module passes of a configuration to a pass
+// manager. The module pipeline built from the levels is not split into
+// named passes.
+func addModulePasses(config OptimizationConfig, modulePassManager llvm.PassManager) {
+	if config.Passes == nil {
+		builder := llvm.NewPassManagerBuilder()
+		builder.SetOptLevel(config.Level)
+		builder.SetSizeLevel(config.SizeLevel)
+		if config.Level > 1 || config.SizeLevel > 0 {
+			builder.UseInlinerWithThreshold(inlineThreshold(config))
+		}
+		builder.Populate(modulePassManager)
+		builder.Dispose()
+		return
+	}
+	for _, name := range config.Passes {
+		if pass := namedPasses[name]; pass.isModulePass {
+			pass.add(modulePassManager)
+		}
+	}
+}
+
+// PassNames lists the passes which can be used in OptimizationConfig.Passes.
+func PassNames() []string {
+	names := make([]string, 0, len(namedPasses))
+	for name := range namedPasses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParsePasses reads a comma separated list of pass names.
+func ParsePasses(list string) ([]string, error) {
+	passes := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, found := namedPasses[name]; !found {
+			return nil, errors.New("Unknown pass: " + name + ", available passes: " + strings.Join(PassNames(), ", "))
+		}
+		passes = append(passes, name)
+	}
+	return passes, nil
+}
+
+// inlineThreshold mimics the thresholds used by clang for each level.
+func inlineThreshold(config OptimizationConfig) uint {
+	switch {
+	case config.SizeLevel == 1:
+		return 75
+	case config.SizeLevel > 1:
+		return 25
+	case config.Level > 2:
+		return 275
+	}
+	return 225
+}
+
+// levelName returns the name of the option selecting the levels of a
+// pipeline, such as O2 or Oz.
+func levelName(config OptimizationConfig) string {
+	switch {
+	case config.SizeLevel == 1:
+		return "Os"
+	case config.SizeLevel > 1:
+		return "Oz"
+	}
+	return fmt.Sprintf("O%d", config.Level)
+}
+
+// newPassManagers returns the function and module pass managers of a module.
+func newPassManagers(module llvm.Module, config OptimizationConfig) (llvm.PassManager, llvm.PassManager) {
+	for _, name := range config.Passes {
+		if _, found := namedPasses[name]; !found {
+			panic("Unknown pass: " + name)
+		}
+	}
+	functionPassManager := llvm.NewFunctionPassManagerForModule(module)
+	for _, name := range functionPasses(config) {
+		namedPasses[name].add(functionPassManager)
+	}
+	functionPassManager.InitializeFunc()
+	modulePassManager := llvm.NewPassManager()
+	addModulePasses(config, modulePassManager)
+	return functionPassManager, modulePassManager
+}
+
+func countInstructions(function llvm.Value) int {
+	count := 0
+	for block := function.FirstBasicBlock(); !block.IsNil(); block = llvm.NextBasicBlock(block) {
+		for instruction := block.FirstInstruction(); !instruction.IsNil(); instruction = llvm.NextInstruction(instruction) {
+			count++
+		}
+	}
+	return count
+}
+
+func newPassStage(pass string, function llvm.Value) PassStage {
+	return PassStage{Pass: pass, IR: function.GlobalParent().String(), InstructionCount: countInstructions(function)}
+}
+
+// runFunctionPassesByStage runs the function passes one at a time, recording
+// the IR after each one. The module passes, which run later on the whole
+// module, are then recorded on a copy of the module.
+func runFunctionPassesByStage(function llvm.Value, config OptimizationConfig) []PassStage {
+	stages := []PassStage{newPassStage("input", function)}
+	for _, name := range functionPasses(config) {
+		singlePassManager := llvm.NewFunctionPassManagerForModule(function.GlobalParent())
+		namedPasses[name].add(singlePassManager)
+		singlePassManager.InitializeFunc()
+		singlePassManager.RunFunc(function)
+		singlePassManager.FinalizeFunc()
+		singlePassManager.Dispose()
+		stages = append(stages, newPassStage(name, function))
+	}
+	return append(stages, moduleStages(function, config)...)
+}
+
+// moduleStages runs the module passes one at a time on a copy of the module
+// of a function, recording the IR after each one. The module pipeline built
+// from the levels is recorded as a single stage.
+func moduleStages(function llvm.Value, config OptimizationConfig) []PassStage {
+	clone := cloneModule(function.GlobalParent())
+	defer clone.Dispose()
+	run := func(pass string, add func(llvm.PassManager)) PassStage {
+		passManager := llvm.NewPassManager()
+		defer passManager.Dispose()
+		add(passManager)
+		passManager.Run(clone)
+		// A private function may have been removed, once inlined.
+		if clonedFunction := clone.NamedFunction(function.Name()); !clonedFunction.IsNil() {
+			return newPassStage(pass, clonedFunction)
+		}
+		return PassStage{Pass: pass, IR: clone.String()}
+	}
+	if config.Passes == nil {
+		return []PassStage{run(levelName(config)+" module pipeline", func(passManager llvm.PassManager) {
+			addModulePasses(config, passManager)
+		})}
+	}
+	stages := []PassStage{}
+	for _, name := range config.Passes {
+		if pass := namedPasses[name]; pass.isModulePass {
+			stages = append(stages, run(name, pass.add))
+		}
+	}
+	return stages
+}
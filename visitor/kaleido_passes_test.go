@@ -0,0 +1,123 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOptimizationConfigs(t *testing.T) {
+	configs := []OptimizationConfig{
+		DefaultOptimization,
+		NoOptimization,
+		{Level: 0},
+		{Level: 3},
+		{Level: 2, SizeLevel: 1},
+		{Passes: []string{"inline", "globaldce", "instcombine", "gvn"}},
+	}
+	for _, config := range configs {
+		visitor := NewVisitorKaleido()
+		visitor.SetOptimization(config)
+		feed(t, &visitor, "def sq(x) x * x def f(x) sq(x) + sq(x) + 1 * x")
+		if result := feedAndEvaluate(t, &visitor, "f(3)"); result != 21 {
+			t.Errorf("Config %+v: was waiting for 21 but received %v", config, result)
+		}
+	}
+}
+
+func TestParsePasses(t *testing.T) {
+	passes, err := ParsePasses("inline, gvn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passes) != 2 || passes[0] != "inline" || passes[1] != "gvn" {
+		t.Error("Unexpected passes", passes)
+	}
+	if _, err := ParsePasses("gvn,unknown"); err == nil {
+		t.Error("Was waiting for an error")
+	}
+}
+
+func TestPassObserver(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	var observedFunction string
+	var observedStages []PassStage
+	visitor.SetPassObserver(func(function string, stages []PassStage) {
+		observedFunction, observedStages = function, stages
+	})
+	feed(t, &visitor, "def f(x) (x + 1) * (x + 1)")
+	if observedFunction != "f" {
+		t.Fatal("Stages of f were not observed")
+	}
+	if len(observedStages) != len(DefaultOptimization.Passes)+1 || observedStages[0].Pass != "input" {
+		t.Fatal("Unexpected stages", observedStages)
+	}
+	first, last := observedStages[0], observedStages[len(observedStages)-1]
+	if last.InstructionCount >= first.InstructionCount {
+		t.Errorf("GVN should have removed an instruction, counts: %d then %d", first.InstructionCount, last.InstructionCount)
+	}
+}
+
+func TestPassObserverLevels(t *testing.T) {
+	configs := map[string]OptimizationConfig{
+		"O2": {Level: 2},
+		"Os": {Level: 2, SizeLevel: 1},
+		"Oz": {Level: 2, SizeLevel: 2},
+	}
+	for name, config := range configs {
+		visitor := NewVisitorKaleido()
+		visitor.SetOptimization(config)
+		var observedStages []PassStage
+		visitor.SetPassObserver(func(function string, stages []PassStage) {
+			observedStages = stages
+		})
+		feed(t, &visitor, "def f(x) (x + 1) * (x + 1)")
+		passes := []string{}
+		for _, stage := range observedStages {
+			passes = append(passes, stage.Pass)
+		}
+		expected := "input lower-expect simplifycfg sroa early-cse " + name + " module pipeline"
+		if got := strings.Join(passes, " "); got != expected {
+			t.Errorf("Was waiting for the stages %q, received %q", expected, got)
+		}
+		visitor.Close()
+	}
+}
+
+func TestPassObserverModulePasses(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	visitor.SetOptimization(OptimizationConfig{Passes: []string{"instcombine", "inline"}})
+	feed(t, &visitor, "def sq(x) x * x")
+	var observedStages []PassStage
+	visitor.SetPassObserver(func(function string, stages []PassStage) {
+		observedStages = stages
+	})
+	feed(t, &visitor, "def f(x) sq(x) + 1")
+	if len(observedStages) != 3 || observedStages[1].Pass != "instcombine" || observedStages[2].Pass != "inline" {
+		t.Fatalf("Unexpected stages %v", observedStages)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+)
+
+func newHostTargetMachine(relocMode llvm.RelocMode) (llvm.TargetMachine, error) {
+	triple := llvm.DefaultTargetTriple()
+	target, err := llvm.GetTargetFromTriple(triple)
+	if err != nil {
+		return llvm.TargetMachine{}, err
+	}
+	targetMachine := target.CreateTargetMachine(triple, "", "",
+		llvm.CodeGenLevelDefault, relocMode, llvm.CodeModelDefault)
+	return targetMachine, nil
+}
+
+func emitAssembly(module llvm.Module) (string, error) {
+	assembly, err := emitMachineCode(module, llvm.AssemblyFile, llvm.RelocDefault)
+	return string(assembly), err
+}
+
+// EmitObject returns the native object code of a module, position
+// independent so it can be linked into executables and shared libraries.
+func EmitObject(module llvm.Module) ([]byte, error) {
+	return emitMachineCode(module, llvm.ObjectFile, llvm.RelocPIC)
+}
+
+func emitMachineCode(module llvm.Module, fileType llvm.CodeGenFileType, relocMode llvm.RelocMode) ([]byte, error) {
+	targetMachine, err := newHostTargetMachine(relocMode)
+	if err != nil {
+		return nil, err
+	}
+	defer targetMachine.Dispose()
+	buffer, err := targetMachine.EmitToMemoryBuffer(module, fileType)
+	if err != nil {
+		return nil, err
+	}
+	defer buffer.Dispose()
+	return append([]byte{}, buffer.Bytes()...), nil
+}
@@ -0,0 +1,491 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+)
+
+// typeUntypedInt is the type of an integer literal, which takes the type
+// required where it is used, double by default.
+const typeUntypedInt parser.Type = "untyped int"
+
+// typeError stops the compilation with an error located at pos, when known.
+func typeError(pos parser.Pos, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if pos.IsValid() {
+		message = pos.String() + ": " + message
+	}
+	panic(message)
+}
+
+func (v *VisitorKaleido) llvmType(t parser.Type) llvm.Type {
+	switch t {
+	case parser.TypeInt, parser.TypeI64:
+		return v.context.Int64Type()
+	case parser.TypeBool:
+		return v.context.Int1Type()
+	case parser.TypeI8:
+		return v.context.Int8Type()
+	case parser.TypeI16:
+		return v.context.Int16Type()
+	case parser.TypeI32:
+		return v.context.Int32Type()
+	case parser.TypeF32:
+		return v.context.FloatType()
+	case parser.TypeVoid:
+		return v.context.VoidType()
+	case parser.TypePtr:
+		return llvm.PointerType(v.context.Int8Type(), 0)
+	}
+	if t.IsPointer() {
+		pointed := t[:len(t)-1]
+		if pointed == parser.TypeVoid {
+			pointed = parser.TypeI8
+		}
+		return llvm.PointerType(v.llvmType(pointed), 0)
+	}
+	return v.context.DoubleType()
+}
+
+func (v *VisitorKaleido) functionType(prototype *parser.PrototypeAST) llvm.Type {
+	paramTypes := make([]llvm.Type, 0, len(prototype.Args))
+	for i := range prototype.Args {
+		paramTypes = append(paramTypes, v.llvmType(prototype.ArgType(i)))
+	}
+	return llvm.FunctionType(v.llvmType(prototype.ReturnType), paramTypes, prototype.Variadic)
+}
+
+// sameSignature tells if two prototypes have the same types.
+func sameSignature(a *parser.PrototypeAST, b *parser.PrototypeAST) bool {
+	if len(a.Args) != len(b.Args) || resultType(a) != resultType(b) || a.Variadic != b.Variadic {
+		return false
+	}
+	for i := range a.Args {
+		if a.ArgType(i) != b.ArgType(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// signature returns the types of a prototype, as in (int double): bool.
+func signature(prototype *parser.PrototypeAST) string {
+	types := make([]string, 0, len(prototype.Args))
+	for i := range prototype.Args {
+		types = append(types, string(prototype.ArgType(i)))
+	}
+	if prototype.Variadic {
+		types = append(types, "...")
+	}
+	return fmt.Sprintf("(%s): %s", strings.Join(types, " "), resultType(prototype))
+}
+
+// resultType returns the type of the result of a declaration, a double
+// unless annotated.
+func resultType(prototype *parser.PrototypeAST) parser.Type {
+	if prototype.ReturnType == parser.TypeUnspecified {
+		return parser.TypeDouble
+	}
+	return prototype.ReturnType
+}
+
+// resolveDeclaration checks the annotations of a prototype, and returns a
+// copy with the types of all its arguments and of its result. Only the
+// externs can use the C types and be variadic.
+func resolveDeclaration(prototype *parser.PrototypeAST, extern bool) *parser.PrototypeAST {
+	resolved := *prototype
+	resolved.ArgTypes = make([]parser.Type, len(prototype.Args))
+	for i := range prototype.Args {
+		resolved.ArgTypes[i] = prototype.ArgType(i)
+		checkTypeName(prototype.Pos, resolved.ArgTypes[i], extern)
+		if resolved.ArgTypes[i] == parser.TypeVoid {
+			typeError(prototype.Pos, "Argument %s of %s cannot be void", prototype.Args[i], prototype.FunctionName)
+		}
+	}
+	resolved.ReturnType = resultType(prototype)
+	checkTypeName(prototype.Pos, resolved.ReturnType, extern)
+	if prototype.Variadic && !extern {
+		typeError(prototype.Pos, "Function %s cannot be variadic, only the externs can", prototype.FunctionName)
+	}
+	return &resolved
+}
+
+func checkTypeName(pos parser.Pos, t parser.Type, extern bool) {
+	if parser.IsType(string(t)) {
+		return
+	}
+	if !extern {
+		if t.IsCType() {
+			typeError(pos, "Type %s can only be used by an extern", t)
+		}
+		typeError(pos, "Unknown type %s, the types are double, int, bool and ptr", t)
+	}
+	pointed := t
+	for pointed.IsPointer() {
+		pointed = pointed[:len(pointed)-1]
+	}
+	if !pointed.IsCType() {
+		typeError(pos, "Unknown type %s, the C types are i8, i16, i32, i64, f32, f64, void and their pointers", t)
+	}
+}
+
+// valueType returns the type of the values of a C type in Kaleidoscope: the
+// integers are converted to int, the floats to double and the pointers to
+// ptr. A void result is the double 0. The other types are unchanged.
+func valueType(t parser.Type) parser.Type {
+	switch t {
+	case parser.TypeI8, parser.TypeI16, parser.TypeI32, parser.TypeI64:
+		return parser.TypeInt
+	case parser.TypeF32, parser.TypeF64, parser.TypeVoid:
+		return parser.TypeDouble
+	}
+	if t.IsPointer() {
+		return parser.TypePtr
+	}
+	return t
+}
+
+// variadicType returns the C type of an argument passed to the variadic
+// part of a function, following the C promotions: booleans and integer
+// literals are passed as i32, as the C int.
+func variadicType(t parser.Type) parser.Type {
+	switch t {
+	case typeUntypedInt, parser.TypeBool:
+		return parser.TypeI32
+	}
+	return t
+}
+
+// acceptsArgs tells if a function can be called with the given number of
+// arguments.
+func acceptsArgs(prototype *parser.PrototypeAST, count int) bool {
+	if prototype.Variadic {
+		return count >= len(prototype.Args)
+	}
+	return count == len(prototype.Args)
+}
+
+// hasCValues tells if a function takes or returns values that cannot be
+// exchanged as doubles with Go, pointers or variadic arguments.
+func hasCValues(prototype *parser.PrototypeAST) bool {
+	if prototype.Variadic || valueType(resultType(prototype)) == parser.TypePtr {
+		return true
+	}
+	for i := range prototype.Args {
+		if valueType(prototype.ArgType(i)) == parser.TypePtr {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePrototype checks the types of a function, and returns its
+// prototype with the types of all its arguments and of its result, inferred
+// from the body when not annotated. While checking the body, the function is
+// known under the given name with a double result unless annotated, so it
+// can call itself.
+func (v *VisitorKaleido) resolvePrototype(node *parser.FunctionAST, name string) *parser.PrototypeAST {
+	resolved := resolveDeclaration(&node.Prototype, false)
+	previousProto := v.prototypes[name]
+	v.prototypes[name] = resolved
+	defer v.restorePrototype(name, previousProto)
+	v.namedTypes = make(map[string]parser.Type, len(resolved.Args))
+	for i, arg := range resolved.Args {
+		v.namedTypes[arg] = resolved.ArgTypes[i]
+	}
+	bodyType := v.exprType(node.Body)
+	if node.Prototype.ReturnType != parser.TypeUnspecified {
+		if !assignable(bodyType, resolved.ReturnType) {
+			typeError(node.Prototype.Pos, "Function %s returns %s, not %s", node.Prototype.FunctionName, bodyType, resolved.ReturnType)
+		}
+		return resolved
+	}
+	inferred := defaultType(bodyType)
+	if name == parser.MainFunctionName {
+		// The value of a top level expression is always a double.
+		if !assignable(bodyType, parser.TypeDouble) {
+			typeError(node.Prototype.Pos, "A top level expression cannot be %s", bodyType)
+		}
+		inferred = parser.TypeDouble
+	}
+	if inferred != resolved.ReturnType && v.callsItself(node.Body, name) {
+		typeError(node.Prototype.Pos, "The result of the recursive function %s is %s, it must be annotated", node.Prototype.FunctionName, inferred)
+	}
+	inferredProto := *resolved
+	inferredProto.ReturnType = inferred
+	return &inferredProto
+}
+
+func (v *VisitorKaleido) callsItself(body parser.ExprAST, name string) bool {
+	for _, call := range v.collectCalls(body) {
+		if v.resolveFunction(call.FunctionName) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// exprType returns the type of an expression, checking its calls.
+func (v *VisitorKaleido) exprType(expr parser.ExprAST) parser.Type {
+	switch node := expr.(type) {
+	case parser.NumberExprAST:
+		if strings.Contains(node.Value, ".") {
+			return parser.TypeDouble
+		}
+		return typeUntypedInt
+	case parser.StringExprAST:
+		return parser.TypePtr
+	case parser.VariableExprAST:
+		name := string(node)
+		if t, found := v.namedTypes[name]; found {
+			return t
+		}
+		if _, found := v.constants[name]; found {
+			return parser.TypeDouble
+		}
+		if _, found := v.globals[name]; found {
+			return parser.TypeDouble
+		}
+		panic(fmt.Sprintf("Variable %v not found", name))
+	case *parser.BinaryExprAST:
+		lhs, rhs := v.exprType(node.LHS), v.exprType(node.RHS)
+		if lhs == parser.TypePtr || rhs == parser.TypePtr {
+			typeError(node.Pos, "Operator %c cannot be used on ptr", node.Op)
+		}
+		operand := operandType(lhs, rhs)
+		if node.Op == '<' {
+			return parser.TypeBool
+		}
+		return operand
+	case *parser.CallExprAST:
+		if v.isConversion(node) {
+			if len(node.Args) != 1 {
+				typeError(node.Pos, "Conversion to %s takes one argument", node.FunctionName)
+			}
+			target := parser.Type(node.FunctionName)
+			if argType := v.exprType(node.Args[0]); (argType == parser.TypePtr) != (target == parser.TypePtr) {
+				typeError(node.Pos, "Cannot convert %s to %s", defaultType(argType), target)
+			}
+			return target
+		}
+		prototype := v.calledPrototype(node)
+		for i, arg := range node.Args {
+			argType := v.exprType(arg)
+			if i >= len(prototype.Args) {
+				// Variadic argument, passed with its own type.
+				continue
+			}
+			paramType := valueType(prototype.ArgType(i))
+			switch {
+			case assignable(argType, paramType):
+			case paramType == parser.TypePtr || argType == parser.TypePtr:
+				typeError(node.Pos, "Cannot use %s as %s in argument %d of %s", argType, paramType, i+1, node.FunctionName)
+			default:
+				typeError(node.Pos, "Cannot use %s as %s in argument %d of %s, convert it with %s()",
+					argType, paramType, i+1, node.FunctionName, paramType)
+			}
+		}
+		return valueType(resultType(prototype))
+	}
+	panic(fmt.Sprintf("Unknown expression %T", expr))
+}
+
+// isConversion tells if a call converts its argument to a type, as in
+// int(x). A function with the name of a type hides the conversion.
+func (v *VisitorKaleido) isConversion(node *parser.CallExprAST) bool {
+	return parser.IsType(node.FunctionName) && v.prototypes[v.resolveFunction(node.FunctionName)] == nil
+}
+
+// calledPrototype returns the prototype of the function called.
+func (v *VisitorKaleido) calledPrototype(node *parser.CallExprAST) *parser.PrototypeAST {
+	prototype, found := v.prototypes[v.resolveFunction(node.FunctionName)]
+	if !found {
+		typeError(node.Pos, "Function %s does not exist", node.FunctionName)
+	}
+	if !acceptsArgs(prototype, len(node.Args)) {
+		typeError(node.Pos, "Function %s: incorrect number of arguments", node.FunctionName)
+	}
+	return prototype
+}
+
+// operandType returns the type both operands of a binary operator are
+// converted to: booleans are used as integers, and integers as doubles when
+// mixed with doubles.
+func operandType(lhs parser.Type, rhs parser.Type) parser.Type {
+	switch {
+	case lhs == parser.TypeDouble || rhs == parser.TypeDouble:
+		return parser.TypeDouble
+	case lhs == parser.TypeInt || rhs == parser.TypeInt || lhs == parser.TypeBool || rhs == parser.TypeBool:
+		return parser.TypeInt
+	}
+	return typeUntypedInt
+}
+
+// assignable tells if a value can be implicitly converted: the conversions
+// not losing information are implicit, the others need int(), double() or
+// bool().
+func assignable(from parser.Type, to parser.Type) bool {
+	switch {
+	case from == to:
+		return true
+	case from == parser.TypePtr || to == parser.TypePtr:
+		return false
+	case to == parser.TypeDouble:
+		return true
+	case to == parser.TypeInt:
+		return from == parser.TypeBool || from == typeUntypedInt
+	}
+	return false
+}
+
+// defaultType returns the type of a value whose type is not constrained.
+func defaultType(t parser.Type) parser.Type {
+	if t == typeUntypedInt {
+		return parser.TypeDouble
+	}
+	return t
+}
+
+// emitExpr generates an expression converted to the given type.
+func (v *VisitorKaleido) emitExpr(expr parser.ExprAST, target parser.Type) llvm.Value {
+	exprType := v.exprType(expr)
+	if number, isNumber := expr.(parser.NumberExprAST); isNumber && exprType == typeUntypedInt && target == parser.TypeInt {
+		value, err := strconv.ParseInt(number.Value, 10, 64)
+		if err != nil {
+			typeError(number.Pos, "Integer %s does not fit in an int", number.Value)
+		}
+		return llvm.ConstInt(v.context.Int64Type(), uint64(value), true)
+	}
+	return v.convert(expr.Accept(v).(llvm.Value), exprType, target)
+}
+
+// convert generates the conversion of a value between two types. An
+// untyped integer has been generated as a double. A double is converted to
+// an int by truncation and saturates: NaN gives 0, and a value out of range
+// gives the smallest or largest int.
+func (v *VisitorKaleido) convert(value llvm.Value, from parser.Type, to parser.Type) llvm.Value {
+	from = defaultType(from)
+	if from == to {
+		return value
+	}
+	switch {
+	case to == parser.TypeDouble && from == parser.TypeInt:
+		return v.builder.CreateSIToFP(value, v.context.DoubleType(), "convtmp")
+	case to == parser.TypeDouble && from == parser.TypeBool:
+		return v.builder.CreateUIToFP(value, v.context.DoubleType(), "booltmp")
+	case to == parser.TypeInt && from == parser.TypeDouble:
+		return v.builder.CreateCall(v.saturatingFPToSI(), []llvm.Value{value}, "convtmp")
+	case to == parser.TypeInt && from == parser.TypeBool:
+		return v.builder.CreateZExt(value, v.context.Int64Type(), "booltmp")
+	case to == parser.TypeBool && from == parser.TypeDouble:
+		return v.builder.CreateFCmp(llvm.FloatUNE, value, llvm.ConstFloat(v.context.DoubleType(), 0), "booltmp")
+	case to == parser.TypeBool && from == parser.TypeInt:
+		return v.builder.CreateICmp(llvm.IntNE, value, llvm.ConstInt(v.context.Int64Type(), 0, false), "booltmp")
+	}
+	panic(fmt.Sprintf("Cannot convert %s to %s", from, to))
+}
+
+// saturatingFPToSI declares the intrinsic converting a double to an int
+// without the undefined result of fptosi for NaN and out of range values.
+func (v *VisitorKaleido) saturatingFPToSI() llvm.Value {
+	const name = "llvm.fptosi.sat.i64.f64"
+	intrinsic := v.lastModule.NamedFunction(name)
+	if intrinsic.IsNil() {
+		intrinsic = llvm.AddFunction(*v.lastModule, name, llvm.FunctionType(v.context.Int64Type(), []llvm.Type{v.context.DoubleType()}, false))
+	}
+	return intrinsic
+}
+
+// emitCallArg generates an argument of a call converted to the C type of
+// the parameter.
+func (v *VisitorKaleido) emitCallArg(expr parser.ExprAST, paramType parser.Type) llvm.Value {
+	return v.toC(v.emitExpr(expr, valueType(paramType)), paramType)
+}
+
+// toC converts a value to a C type, from the type returned by valueType.
+func (v *VisitorKaleido) toC(value llvm.Value, t parser.Type) llvm.Value {
+	switch {
+	case t == parser.TypeI8 || t == parser.TypeI16 || t == parser.TypeI32:
+		return v.builder.CreateTrunc(value, v.llvmType(t), "ctmp")
+	case t == parser.TypeF32:
+		return v.builder.CreateFPTrunc(value, v.llvmType(t), "ctmp")
+	case t.IsPointer() && value.Type() != v.llvmType(t):
+		return v.builder.CreateBitCast(value, v.llvmType(t), "ctmp")
+	}
+	return value
+}
+
+// fromC converts a value of a C type, but void, to the type returned by
+// valueType.
+func (v *VisitorKaleido) fromC(value llvm.Value, t parser.Type) llvm.Value {
+	switch {
+	case t == parser.TypeI8 || t == parser.TypeI16 || t == parser.TypeI32:
+		return v.builder.CreateSExt(value, v.context.Int64Type(), "valtmp")
+	case t == parser.TypeF32:
+		return v.builder.CreateFPExt(value, v.context.DoubleType(), "valtmp")
+	case t.IsPointer() && value.Type() != v.llvmType(parser.TypePtr):
+		return v.builder.CreateBitCast(value, v.llvmType(parser.TypePtr), "valtmp")
+	}
+	return value
+}
+
+// emitCall generates a call, the result being converted from its C type.
+func (v *VisitorKaleido) emitCall(callee llvm.Value, prototype *parser.PrototypeAST, args []llvm.Value) llvm.Value {
+	result := resultType(prototype)
+	if result == parser.TypeVoid {
+		// A call without result cannot be named, its value is 0.
+		v.builder.CreateCall(callee, args, "")
+		return llvm.ConstFloat(v.context.DoubleType(), 0)
+	}
+	return v.fromC(v.builder.CreateCall(callee, args, "calltmp"), result)
+}
+
+// addExtensionAttributes marks the arguments and the result of types
+// smaller than 32 bits as sign extended, as the C calling conventions
+// expect for the signed integers. A boolean result is zero extended, as a C
+// bool.
+func (v *VisitorKaleido) addExtensionAttributes(llvmFunc llvm.Value, prototype *parser.PrototypeAST) {
+	signExt := v.context.CreateEnumAttribute(llvm.AttributeKindID("signext"), 0)
+	isSmall := func(t parser.Type) bool {
+		return t == parser.TypeI8 || t == parser.TypeI16
+	}
+	switch {
+	case isSmall(prototype.ReturnType):
+		llvmFunc.AddAttributeAtIndex(0, signExt)
+	case prototype.ReturnType == parser.TypeBool:
+		llvmFunc.AddAttributeAtIndex(0, v.context.CreateEnumAttribute(llvm.AttributeKindID("zeroext"), 0))
+	}
+	for i := range prototype.Args {
+		if isSmall(prototype.ArgType(i)) {
+			llvmFunc.AddAttributeAtIndex(i+1, signExt)
+		}
+	}
+}
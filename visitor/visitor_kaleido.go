@@ -27,89 +27,593 @@ package visitor
 import (
 	"errors"
 	"fmt"
-	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unsafe"
 
 	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
 	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/trace"
 )
 
-func newModuleAndPassManager() (*llvm.Module, *llvm.PassManager) {
-	module := llvm.NewModule("")
-	passManager := llvm.NewFunctionPassManagerForModule(module)
-	passManager.AddInstructionCombiningPass()
-	passManager.AddReassociatePass()
-	passManager.AddGVNPass()
-	passManager.AddCFGSimplificationPass()
-	passManager.InitializeFunc()
-	return &module, &passManager
+func newModuleAndPassManagers(context llvm.Context, optimization OptimizationConfig) (*llvm.Module, *llvm.PassManager, *llvm.PassManager) {
+	module := context.NewModule("")
+	functionPassManager, modulePassManager := newPassManagers(module, optimization)
+	return &module, &functionPassManager, &modulePassManager
 }
 
+// functionStub is the indirection used to call a user defined function.
+// Callers always call the stub, which jumps to the implementation stored
+// in a global slot, so redefining a function only needs to update the slot
+// and the callers compiled earlier pick up the new body. The slot is accessed
+// atomically, as compiled functions may run while it is updated.
+type functionStub struct {
+	symbol    string
+	slot      string
+	arity     int
+	prototype *parser.PrototypeAST
+}
+
+// VisitorKaleido compiles the AST, and evaluates it with the JIT. It is not
+// safe for concurrent use: the compilation must be serialized by the caller,
+// only the functions returned by CompiledFunction can be called
+// concurrently.
 type VisitorKaleido struct {
-	context         *llvm.Context
-	lastModule      *llvm.Module
-	jit             *KaleidoscopeJIT
-	builder         *llvm.Builder
-	lastPassManager *llvm.PassManager
-	namedValues     map[string]interface{}
-	prototypes      map[string]*parser.PrototypeAST
+	context               *llvm.Context
+	lastModule            *llvm.Module
+	jit                   *KaleidoscopeJIT
+	builder               *llvm.Builder
+	lastPassManager       *llvm.PassManager
+	lastModulePassManager *llvm.PassManager
+	namedValues           map[string]interface{}
+	namedTypes            map[string]parser.Type
+	prototypes            map[string]*parser.PrototypeAST
+	stubs                 map[string]map[int]*functionStub
+	versions              map[string]int
+	definitions           map[string]llvm.Value
+	linked                map[string]bool
+	accepted              []parser.Visitable
+	callees               map[string][]string
+	currentCallees        []string
+	warnings              []string
+	optimization          OptimizationConfig
+	tracer                *trace.Tracer
+	passObserver          PassObserver
+	topLevelFunctions     []string
+	units                 map[string]string
+	currentFile           string
+	cache                 *CompilationCache
+	dependencies          map[string][]string
+	workers               int
+	replaceableModules    map[string]replaceableModule
+	entryPoints           map[string]*CompiledFunction
+	interruptible         bool
+	callSettings          *callSettings
+	externPolicy          ExternPolicy
+	goFunctions           map[string]*goFunction
+	constants             map[string]float64
+	globals               map[string]*Global
+	libraries             []string
+	replaced              []string
+	closed                bool
+}
+
+// replaceableModule is the module of the current version of a function,
+// which can be removed from the JIT once the function is redefined with the
+// same number of arguments: nothing refers to it anymore.
+type replaceableModule struct {
+	module llvm.Module
+	arity  int
+}
+
+// FunctionInfo describes a function known by the visitor, either defined
+// or declared as extern.
+type FunctionInfo struct {
+	Name       string
+	Args       []string
+	ArgTypes   []parser.Type
+	ReturnType parser.Type
+	Variadic   bool
+	Extern     bool
 }
 
 func NewVisitorKaleido() VisitorKaleido {
 	context := llvm.NewContext()
-	module, passManager := newModuleAndPassManager()
+	module, passManager, modulePassManager := newModuleAndPassManagers(context, DefaultOptimization)
 	builder := context.NewBuilder()
-	jit := NewKaleidoJIT(module)
+	jit := NewKaleidoJIT(context)
 	return VisitorKaleido{
-		context:         &context,
-		lastModule:      module,
-		jit:             &jit,
-		lastPassManager: passManager,
-		prototypes:      make(map[string]*parser.PrototypeAST),
-		builder:         &builder}
+		context:               &context,
+		lastModule:            module,
+		jit:                   &jit,
+		lastPassManager:       passManager,
+		lastModulePassManager: modulePassManager,
+		prototypes:            make(map[string]*parser.PrototypeAST),
+		stubs:                 make(map[string]map[int]*functionStub),
+		versions:              make(map[string]int),
+		definitions:           make(map[string]llvm.Value),
+		linked:                make(map[string]bool),
+		callees:               make(map[string][]string),
+		units:                 make(map[string]string),
+		dependencies:          make(map[string][]string),
+		replaceableModules:    make(map[string]replaceableModule),
+		entryPoints:           make(map[string]*CompiledFunction),
+		callSettings:          newCallSettings(),
+		goFunctions:           make(map[string]*goFunction),
+		constants:             make(map[string]float64),
+		globals:               make(map[string]*Global),
+		optimization:          DefaultOptimization,
+		builder:               &builder}
+}
+
+// NewVisitorKaleidoAOT returns a visitor compiling the whole program into a
+// single module targeting the host, for ahead of time compilation. There is
+// no JIT, so nothing can be evaluated.
+func NewVisitorKaleidoAOT() (VisitorKaleido, error) {
+	targetMachine, err := newHostTargetMachine(llvm.RelocPIC)
+	if err != nil {
+		return VisitorKaleido{}, err
+	}
+	defer targetMachine.Dispose()
+	targetData := targetMachine.CreateTargetData()
+	defer targetData.Dispose()
+	visitor := NewVisitorKaleido()
+	visitor.jit.Dispose()
+	visitor.jit = nil
+	visitor.lastModule.SetTarget(targetMachine.Triple())
+	visitor.lastModule.SetDataLayout(targetData.String())
+	return visitor, nil
+}
+
+// Module runs the module passes then returns the module of an ahead of time
+// compilation, which holds the whole program.
+func (v *VisitorKaleido) Module() (llvm.Module, error) {
+	if v.jit != nil {
+		return llvm.Module{}, errors.New("The program is split into several modules for the JIT")
+	}
+	v.lastModulePassManager.Run(*v.lastModule)
+	if err := llvm.VerifyModule(*v.lastModule, llvm.ReturnStatusAction); err != nil {
+		return llvm.Module{}, err
+	}
+	return *v.lastModule, nil
+}
+
+// LinkBitcodeLibrary links a bitcode file into the current module. Its
+// external functions taking and returning doubles can then be called.
+func (v *VisitorKaleido) LinkBitcodeLibrary(path string) error {
+	library, err := parseBitcodeFile(*v.context, path)
+	if err != nil {
+		return err
+	}
+	var prototypes []*parser.PrototypeAST
+	for function := library.FirstFunction(); !function.IsNil(); function = llvm.NextFunction(function) {
+		if function.IsDeclaration() || function.Linkage() != llvm.ExternalLinkage || !isKaleidoFunction(function) {
+			continue
+		}
+		args := make([]string, 0, function.ParamsCount())
+		for i, param := range function.Params() {
+			argName := param.Name()
+			if argName == "" {
+				argName = fmt.Sprintf("arg%d", i)
+			}
+			args = append(args, argName)
+		}
+		prototypes = append(prototypes, &parser.PrototypeAST{FunctionName: function.Name(), Args: args})
+	}
+	if v.lastModule.DataLayout() == "" {
+		v.lastModule.SetDataLayout(library.DataLayout())
+		v.lastModule.SetTarget(library.Target())
+	}
+	if err := llvm.LinkModules(*v.lastModule, library); err != nil {
+		return err
+	}
+	for _, prototype := range prototypes {
+		v.prototypes[prototype.FunctionName] = prototype
+		v.linked[prototype.FunctionName] = true
+		v.tracer.Infof(trace.Codegen, "Function %s linked from %s", prototype.FunctionName, path)
+	}
+	if v.jit != nil {
+		// The library gets its own module, which keeps the modules of the
+		// functions suitable for the compilation cache.
+		v.switchModule()
+	}
+	return nil
+}
+
+func isKaleidoFunction(function llvm.Value) bool {
+	functionType := function.Type().ElementType()
+	doubleType := functionType.Context().DoubleType()
+	if functionType.ReturnType() != doubleType || functionType.IsFunctionVarArg() {
+		return false
+	}
+	for _, paramType := range functionType.ParamTypes() {
+		if paramType != doubleType {
+			return false
+		}
+	}
+	return true
 }
 
+// Close releases the LLVM resources of the visitor: the JIT with its
+// modules, the current module and its pass managers, the builder and the
+// context. The visitor, and the module returned by Module, cannot be used
+// anymore.
+func (v *VisitorKaleido) Close() {
+	if v.closed || v.context == nil {
+		return
+	}
+	v.closed = true
+	v.unregisterGoFunctions()
+	v.SetOutput(nil)
+	v.lastPassManager.Dispose()
+	v.lastModulePassManager.Dispose()
+	v.lastModule.Dispose()
+	if v.jit != nil {
+		v.jit.Dispose()
+	}
+	v.freeGlobals()
+	v.callSettings.free()
+	v.builder.Dispose()
+	v.context.Dispose()
+}
+
+// switchModule hands the current module over to the JIT and starts a new
+// one. Modules must only be added once complete: the JIT compiles all the
+// modules it knows about when a function is run.
 func (v *VisitorKaleido) switchModule() {
-	newModule, newPassManager := newModuleAndPassManager()
-	v.jit.AddModule(*newModule)
+	v.jit.AddModule(*v.lastModule)
+	v.lastPassManager.Dispose()
+	v.lastModulePassManager.Dispose()
+	newModule, newPassManager, newModulePassManager := newModuleAndPassManagers(*v.context, v.optimization)
 	v.lastModule = newModule
 	v.lastPassManager = newPassManager
+	v.lastModulePassManager = newModulePassManager
 }
 
 func (v *VisitorKaleido) FeedAST(node *parser.ProgramAST) (err error) {
+	rollback := v.snapshotDeclarations()
 	defer func() {
 		if r := recover(); r != nil {
-			switch recoveredError := r.(type) {
-			case error:
-				err = recoveredError
-			case string:
-				err = errors.New(recoveredError)
-			default:
-				err = errors.New("Panic occured, recovered")
-			}
+			err = recoveredError(r)
+		}
+		if err != nil {
+			rollback()
 		}
 	}()
+	if len(node.Imports) != 0 {
+		return fmt.Errorf("Import of %q must be resolved by the loader", node.Imports[0].Path)
+	}
+	if err := v.checkExterns(node); err != nil {
+		return err
+	}
+	if v.workers > 1 && v.passObserver == nil {
+		v.feedParallel(node)
+		return nil
+	}
 	node.Accept(v)
 	return nil
 }
 
+// snapshotDeclarations returns a function rolling back the declarations
+// made since the snapshot, when a program fails to compile: the prototypes
+// of the functions not defined meanwhile are restored, and the externs are
+// removed from the accepted definitions. The functions compiled meanwhile
+// stay defined with their prototypes.
+func (v *VisitorKaleido) snapshotDeclarations() func() {
+	prototypes := make(map[string]*parser.PrototypeAST, len(v.prototypes))
+	for name, prototype := range v.prototypes {
+		prototypes[name] = prototype
+	}
+	definitions := make(map[string]llvm.Value, len(v.definitions))
+	for name, definition := range v.definitions {
+		definitions[name] = definition
+	}
+	accepted := len(v.accepted)
+	return func() {
+		names := make(map[string]bool, len(v.prototypes))
+		for name := range v.prototypes {
+			names[name] = true
+		}
+		for name := range prototypes {
+			names[name] = true
+		}
+		for name := range names {
+			if v.definitions[name] == definitions[name] {
+				v.restorePrototype(name, prototypes[name])
+			}
+		}
+		kept := v.accepted[:accepted]
+		for _, node := range v.accepted[accepted:] {
+			if _, isExtern := node.(*parser.PrototypeAST); !isExtern {
+				kept = append(kept, node)
+			}
+		}
+		v.accepted = kept
+	}
+}
+
+// recoveredError converts a recovered panic of the code generation.
+func recoveredError(r interface{}) error {
+	switch recovered := r.(type) {
+	case error:
+		return recovered
+	case string:
+		return errors.New(recovered)
+	default:
+		return errors.New("Panic occured, recovered")
+	}
+}
+
 func (v *VisitorKaleido) GenerateLastModuleIR() string {
 	return v.lastModule.String()
 }
 
 func (v *VisitorKaleido) EvalutateMain() (float64, error) {
-	return v.jit.Run("__main__")
+	if v.jit == nil {
+		return 0, errors.New("No JIT to evaluate the program, it is compiled ahead of time")
+	}
+	main, err := v.CompiledFunction(parser.MainFunctionName)
+	if err != nil {
+		return 0, err
+	}
+	v.tracer.Infof(trace.JIT, "Running %s", parser.MainFunctionName)
+	return main.Call()
+}
+
+// SetTracer sets the tracer of the codegen, passes and JIT categories,
+// nil disabling tracing.
+func (v *VisitorKaleido) SetTracer(tracer *trace.Tracer) {
+	v.tracer = tracer
+	if v.jit != nil {
+		v.jit.tracer = tracer
+	}
+}
+
+// SetInterruptible makes the functions compiled for the JIT from now on
+// check at their entry whether their call is interrupted, so
+// CompiledFunction.CallContext can stop them. It has no effect ahead of
+// time.
+func (v *VisitorKaleido) SetInterruptible(interruptible bool) {
+	v.interruptible = interruptible && v.jit != nil
+}
+
+// SetRecursionLimit limits the depth of the calls run from Go, a deeper call
+// failing with a RecursionLimitError instead of exhausting the stack. The
+// depth is counted by the functions compiled for the JIT from now on, so it
+// should be set before compiling. 0 disables the limit, which has no effect
+// ahead of time.
+func (v *VisitorKaleido) SetRecursionLimit(limit int) {
+	if v.jit != nil {
+		atomic.StoreInt32(&v.callSettings.recursionLimit, int32(limit))
+	}
+}
+
+// SetPassObserver makes the function passes run one at a time, the IR
+// after each one being given to the observer. Nil restores the normal mode.
+func (v *VisitorKaleido) SetPassObserver(observer PassObserver) {
+	v.passObserver = observer
+}
+
+// SetCache enables the compilation cache for the functions compiled for the
+// JIT from now on, nil disables it.
+func (v *VisitorKaleido) SetCache(cache *CompilationCache) {
+	v.cache = cache
+}
+
+// SetOptimization selects the optimization passes run on the functions
+// defined from now on.
+func (v *VisitorKaleido) SetOptimization(optimization OptimizationConfig) {
+	v.optimization = optimization
+	v.lastPassManager.Dispose()
+	v.lastModulePassManager.Dispose()
+	passManager, modulePassManager := newPassManagers(*v.lastModule, optimization)
+	v.lastPassManager = &passManager
+	v.lastModulePassManager = &modulePassManager
+}
+
+// Functions lists the known functions, sorted by name.
+func (v *VisitorKaleido) Functions() []FunctionInfo {
+	functions := make([]FunctionInfo, 0, len(v.prototypes))
+	for name, prototype := range v.prototypes {
+		_, defined := v.definitions[name]
+		argTypes := make([]parser.Type, len(prototype.Args))
+		for i := range prototype.Args {
+			argTypes[i] = prototype.ArgType(i)
+		}
+		functions = append(functions, FunctionInfo{Name: name, Args: prototype.Args, ArgTypes: argTypes, ReturnType: resultType(prototype), Variadic: prototype.Variadic, Extern: !defined})
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		return functions[i].Name < functions[j].Name
+	})
+	return functions
+}
+
+func (v *VisitorKaleido) definitionModule(name string) (llvm.Module, error) {
+	definition, found := v.definitions[name]
+	if !found {
+		return llvm.Module{}, errors.New("Function " + name + " is not defined")
+	}
+	return definition.GlobalParent(), nil
+}
+
+// AcceptedDefinitions returns, in order, the externs, functions, globals
+// and constants successfully defined so far. Replaying them rebuilds the same state.
+func (v *VisitorKaleido) AcceptedDefinitions() []parser.Visitable {
+	return v.accepted
+}
+
+// FunctionIR returns the IR of the module holding the current definition
+// of a function.
+func (v *VisitorKaleido) FunctionIR(name string) (string, error) {
+	module, err := v.definitionModule(name)
+	if err != nil {
+		return "", err
+	}
+	return module.String(), nil
+}
+
+// FunctionAssembly returns the native assembly of the module holding the
+// current definition of a function.
+func (v *VisitorKaleido) FunctionAssembly(name string) (string, error) {
+	module, err := v.definitionModule(name)
+	if err != nil {
+		return "", err
+	}
+	return emitAssembly(module)
+}
+
+// FlushWarnings returns the warnings emitted since the last call, for
+// instance when a redefinition leaves existing callers on an old version.
+func (v *VisitorKaleido) FlushWarnings() []string {
+	warnings := v.warnings
+	v.warnings = nil
+	return warnings
+}
+
+func (v *VisitorKaleido) warn(format string, args ...interface{}) {
+	v.warnings = append(v.warnings, fmt.Sprintf(format, args...))
+}
+
+// stubFor returns the stub used to call the function with the arity of the
+// prototype, and whether it had to be created. A function keeps its plain
+// name as stub symbol, other arities get a suffixed symbol. The types of an
+// existing stub cannot change, as its callers are compiled for them.
+func (v *VisitorKaleido) stubFor(name string, prototype *parser.PrototypeAST) (*functionStub, bool) {
+	arity := len(prototype.Args)
+	if stub, found := v.stubs[name][arity]; found {
+		if !sameSignature(stub.prototype, prototype) {
+			typeError(prototype.Pos, "Function %s cannot change its types from %s to %s", name, signature(stub.prototype), signature(prototype))
+		}
+		return stub, false
+	}
+	symbol := name
+	if len(v.stubs[name]) != 0 {
+		symbol = fmt.Sprintf("%s.arity%d", name, arity)
+	}
+	return &functionStub{symbol: symbol, slot: symbol + ".slot", arity: arity, prototype: prototype}, true
+}
+
+// declareFunction returns a reference, in the current module, to the
+// function to call for the given name and prototype.
+func (v *VisitorKaleido) declareFunction(name string, prototype *parser.PrototypeAST) llvm.Value {
+	symbol := v.calleeSymbol(name, len(prototype.Args))
+	if llvmFunc := v.lastModule.NamedFunction(symbol); !llvmFunc.IsNil() {
+		return llvmFunc
+	}
+	llvmFunc := llvm.AddFunction(*v.lastModule, symbol, v.functionType(prototype))
+	llvmFunc.SetLinkage(llvm.ExternalLinkage)
+	v.addExtensionAttributes(llvmFunc, prototype)
+	return llvmFunc
+}
+
+// calleeSymbol returns the symbol to call for the given name and arity.
+func (v *VisitorKaleido) calleeSymbol(name string, arity int) string {
+	if stub, found := v.stubs[name][arity]; found {
+		return stub.symbol
+	}
+	return name
+}
+
+func (v *VisitorKaleido) slotGlobal(stub *functionStub) llvm.Value {
+	slot := v.lastModule.NamedGlobal(stub.slot)
+	if slot.IsNil() {
+		slot = llvm.AddGlobal(*v.lastModule, llvm.PointerType(v.functionType(stub.prototype), 0), stub.slot)
+	}
+	return slot
+}
+
+// defineStub fills the stub function with a jump to the implementation
+// stored in its slot, and defines the slot in the current module.
+func (v *VisitorKaleido) defineStub(stub *functionStub) llvm.Value {
+	slot := v.slotGlobal(stub)
+	slot.SetInitializer(llvm.ConstPointerNull(slot.Type().ElementType()))
+	stubFunc := v.lastModule.NamedFunction(stub.symbol)
+	if stubFunc.IsNil() {
+		stubFunc = llvm.AddFunction(*v.lastModule, stub.symbol, v.functionType(stub.prototype))
+	}
+	stubFunc.SetLinkage(llvm.ExternalLinkage)
+	v.builder.SetInsertPointAtEnd(v.context.AddBasicBlock(stubFunc, "entry"))
+	implementation := v.builder.CreateLoad(slot, "impl")
+	implementation.SetOrdering(llvm.AtomicOrderingAcquire)
+	implementation.SetAlignment(int(unsafe.Sizeof(uintptr(0))))
+	result := v.builder.CreateCall(implementation, stubFunc.Params(), "calltmp")
+	result.SetTailCall(true)
+	v.builder.CreateRet(result)
+	return stubFunc
+}
+
+// installImplementation generates a function storing the implementation
+// into the slot of the stub, to be run once the module is in the JIT.
+func (v *VisitorKaleido) installImplementation(stub *functionStub, implementation llvm.Value) llvm.Value {
+	installFunc := llvm.AddFunction(*v.lastModule, implementation.Name()+".install", llvm.FunctionType(v.context.VoidType(), nil, false))
+	v.builder.SetInsertPointAtEnd(v.context.AddBasicBlock(installFunc, "entry"))
+	store := v.builder.CreateStore(implementation, v.slotGlobal(stub))
+	store.SetOrdering(llvm.AtomicOrderingRelease)
+	store.SetAlignment(int(unsafe.Sizeof(uintptr(0))))
+	v.builder.CreateRetVoid()
+	return installFunc
+}
+
+// warnStaleCallers reports the functions still calling a previous arity of
+// a redefined function, they keep using its previous definition.
+func (v *VisitorKaleido) warnStaleCallers(name string, previousProto *parser.PrototypeAST, arity int) {
+	if previousProto == nil || len(previousProto.Args) == arity {
+		return
+	}
+	previousStub, found := v.stubs[name][len(previousProto.Args)]
+	if !found {
+		return
+	}
+	staleCallers := []string{}
+	for caller, callees := range v.callees {
+		if caller == name || caller == parser.MainFunctionName {
+			continue
+		}
+		for _, callee := range callees {
+			if callee == previousStub.symbol {
+				staleCallers = append(staleCallers, caller)
+				break
+			}
+		}
+	}
+	if len(staleCallers) == 0 {
+		return
+	}
+	sort.Strings(staleCallers)
+	v.warn("Function %s redefined with %d arguments instead of %d, callers still using the previous definition: %s",
+		name, arity, len(previousProto.Args), strings.Join(staleCallers, ", "))
 }
 
 func (v *VisitorKaleido) VisitNumberExprAST(node *parser.NumberExprAST) interface{} {
-	log.Println("VisitNumberExprAST")
-	value := llvm.ConstFloatFromString(llvm.DoubleType(), string(*node))
+	v.tracer.Debugf(trace.Codegen, "VisitNumberExprAST")
+	value := llvm.ConstFloatFromString(v.context.DoubleType(), node.Value)
 	return value
 }
 
+func (v *VisitorKaleido) VisitStringExprAST(node *parser.StringExprAST) interface{} {
+	v.tracer.Debugf(trace.Codegen, "VisitStringExprAST")
+	return v.builder.CreateGlobalStringPtr(string(*node), "str")
+}
+
 func (v *VisitorKaleido) VisitBinaryExprAST(node *parser.BinaryExprAST) interface{} {
-	log.Println("VisitBinaryExprAST")
-	lhsValue := node.LHS.Accept(v).(llvm.Value)
-	rhsValue := node.RHS.Accept(v).(llvm.Value)
+	v.tracer.Debugf(trace.Codegen, "VisitBinaryExprAST")
+	operand := defaultType(operandType(v.exprType(node.LHS), v.exprType(node.RHS)))
+	lhsValue := v.emitExpr(node.LHS, operand)
+	rhsValue := v.emitExpr(node.RHS, operand)
+	if operand == parser.TypeInt {
+		switch node.Op {
+		case '+':
+			return v.builder.CreateAdd(lhsValue, rhsValue, "addtmp")
+		case '-':
+			return v.builder.CreateSub(lhsValue, rhsValue, "subtmp")
+		case '*':
+			return v.builder.CreateMul(lhsValue, rhsValue, "multmp")
+		case '<':
+			return v.builder.CreateICmp(llvm.IntSLT, lhsValue, rhsValue, "cmptmp")
+		}
+	}
 	switch node.Op {
 	case '+':
 		return v.builder.CreateFAdd(lhsValue, rhsValue, "addtmp")
@@ -118,89 +622,348 @@ func (v *VisitorKaleido) VisitBinaryExprAST(node *parser.BinaryExprAST) interfac
 	case '*':
 		return v.builder.CreateFMul(lhsValue, rhsValue, "multmp")
 	case '<':
-		res := v.builder.CreateFCmp(llvm.FloatULT, lhsValue, rhsValue, "cmptmp")
-		return v.builder.CreateUIToFP(res, llvm.DoubleType(), "booltmp")
+		return v.builder.CreateFCmp(llvm.FloatULT, lhsValue, rhsValue, "cmptmp")
 	}
 	panic(fmt.Sprintf("Unknown operator: %v", node.Op))
 }
 
 func (v *VisitorKaleido) VisitVariableExprAST(node *parser.VariableExprAST) interface{} {
-	log.Println("VisitVariableExprAST")
-	if res, found := v.namedValues[string(*node)]; found {
+	v.tracer.Debugf(trace.Codegen, "VisitVariableExprAST")
+	name := string(*node)
+	if res, found := v.namedValues[name]; found {
 		return res
 	}
+	if value, found := v.constants[name]; found {
+		return llvm.ConstFloat(v.context.DoubleType(), value)
+	}
+	if _, found := v.globals[name]; found {
+		return v.loadGlobal(name)
+	}
 	panic(fmt.Sprintf("Variable %v not found", string(*node)))
 }
 
 func (v *VisitorKaleido) VisitCallExprAST(node *parser.CallExprAST) interface{} {
-	log.Println("VisitCallExprAST")
-	funcRef := v.lastModule.NamedFunction(node.FunctionName)
-	if funcRef.IsNil() {
-		if prototypeAST, ok := v.prototypes[node.FunctionName]; ok {
-			funcRef = prototypeAST.Accept(v).(llvm.Value)
-		} else {
-			panic("Function " + node.FunctionName + " does not exist")
-		}
-	}
-	if funcRef.ParamsCount() != len(node.Args) {
-		panic("Function " + node.FunctionName + ": incorrect number of arguments")
+	v.tracer.Debugf(trace.Codegen, "VisitCallExprAST")
+	if v.isConversion(node) {
+		v.exprType(node)
+		return v.emitExpr(node.Args[0], parser.Type(node.FunctionName))
 	}
+	v.exprType(node)
+	name := v.resolveFunction(node.FunctionName)
+	prototypeAST := v.calledPrototype(node)
+	funcRef := v.declareFunction(name, prototypeAST)
+	v.currentCallees = append(v.currentCallees, funcRef.Name())
 	llvmArgs := make([]llvm.Value, 0, len(node.Args))
-	for _, arg := range node.Args {
-		evaluatedArg := arg.Accept(v).(llvm.Value)
-		llvmArgs = append(llvmArgs, evaluatedArg)
+	for i, arg := range node.Args {
+		paramType := prototypeAST.ArgType(i)
+		if i >= len(prototypeAST.Args) {
+			paramType = variadicType(v.exprType(arg))
+		}
+		llvmArgs = append(llvmArgs, v.emitCallArg(arg, paramType))
 	}
-	return v.builder.CreateCall(funcRef, llvmArgs, "calltmp")
+	return v.emitCall(funcRef, prototypeAST, llvmArgs)
 }
 
 func (v *VisitorKaleido) VisitPrototypeAST(node *parser.PrototypeAST) interface{} {
-	log.Println("VisitPrototypeAST")
-	paramTypes := make([]llvm.Type, 0, len(node.Args))
-	for range node.Args {
-		paramTypes = append(paramTypes, llvm.DoubleType())
+	v.tracer.Debugf(trace.Codegen, "VisitPrototypeAST")
+	prototype := resolveDeclaration(node, true)
+	if node.Library != "" {
+		if err := v.LoadLibrary(node.Library); err != nil {
+			panic(err)
+		}
 	}
-	functionType := llvm.FunctionType(llvm.DoubleType(), paramTypes, false)
-	llvmFunc := llvm.AddFunction(*v.lastModule, node.FunctionName, functionType)
-	llvmFunc.SetLinkage(llvm.ExternalLinkage)
+	if function, found := v.goFunctions[node.FunctionName]; found {
+		if function.arity != len(node.Args) {
+			panic(fmt.Sprintf("Go function %s takes %d arguments, not %d", node.FunctionName, function.arity, len(node.Args)))
+		}
+		if !sameSignature(prototype, v.prototypes[node.FunctionName]) {
+			typeError(node.Pos, "Go function %s takes and returns doubles", node.FunctionName)
+		}
+	}
+	if _, isGoFunction := v.goFunctions[node.FunctionName]; !isGoFunction && v.jit != nil && !v.jit.mapped[node.FunctionName] {
+		// A C function, unlike the runtime library, may write to stdout.
+		atomic.StoreInt32(&v.callSettings.flushStdout, 1)
+	}
+	if stub, found := v.stubs[node.FunctionName][len(node.Args)]; found && !sameSignature(stub.prototype, prototype) {
+		typeError(node.Pos, "Function %s cannot change its types from %s to %s", node.FunctionName, signature(stub.prototype), signature(prototype))
+	}
+	llvmFunc := v.declareFunction(node.FunctionName, prototype)
 	for i, argName := range node.Args {
 		llvmFunc.Params()[i].SetName(argName)
 	}
-	v.prototypes[node.FunctionName] = node
+	v.prototypes[node.FunctionName] = prototype
+	v.accepted = append(v.accepted, node)
 	return llvmFunc
 }
 
 func (v *VisitorKaleido) VisitFunctionAST(node *parser.FunctionAST) interface{} {
-	log.Println("VisitFunctionAST")
-	llvmFunc := v.lastModule.NamedFunction(node.Prototype.FunctionName)
-	if llvmFunc.IsNil() {
-		llvmFunc = node.Prototype.Accept(v).(llvm.Value)
+	v.tracer.Debugf(trace.Codegen, "VisitFunctionAST")
+	name := node.Prototype.FunctionName
+	if node.Private {
+		name = v.privateName(node.Prototype.File, name)
+	}
+	v.currentFile = node.Prototype.File
+	if _, found := v.goFunctions[name]; found {
+		panic(fmt.Sprintf("Function %s is registered from Go, it cannot be defined", name))
+	}
+	if v.jit == nil {
+		return v.defineInModule(node, name, nil)
+	}
+	return v.defineWithStub(node, name, nil)
+}
+
+// privateName returns the name under which a private function of a file is
+// known. In imported files, the name is prefixed by the name of the file and
+// a dot, so other files cannot write it.
+func (v *VisitorKaleido) privateName(file string, name string) string {
+	if file == "" {
+		return name
+	}
+	return v.unitPrefix(file) + "." + name
+}
+
+// unitPrefix returns the prefix of the private functions of a file, unique
+// among the files.
+func (v *VisitorKaleido) unitPrefix(file string) string {
+	prefix, found := v.units[file]
+	if !found {
+		base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		prefix = base
+		for i := 2; v.isUnitPrefix(prefix); i++ {
+			prefix = fmt.Sprintf("%s%d", base, i)
+		}
+		v.units[file] = prefix
 	}
-	if llvmFunc.IsNil() {
-		panic("Function " + node.Prototype.FunctionName + " does not exist")
+	return prefix
+}
+
+func (v *VisitorKaleido) isUnitPrefix(prefix string) bool {
+	for _, used := range v.units {
+		if used == prefix {
+			return true
+		}
 	}
-	if llvmFunc.BasicBlocksCount() != 0 {
-		panic("Function " + node.Prototype.FunctionName + " cannot be redefined")
+	return false
+}
+
+// resolveFunction returns the name of the function called from the current
+// file, its private functions hiding the others.
+func (v *VisitorKaleido) resolveFunction(name string) string {
+	if v.currentFile != "" {
+		if privateName := v.privateName(v.currentFile, name); v.prototypes[privateName] != nil {
+			return privateName
+		}
 	}
+	return name
+}
 
+// emitFunctionBody generates, checks and optimizes the body of a function.
+func (v *VisitorKaleido) emitFunctionBody(llvmFunc llvm.Value, node *parser.FunctionAST, name string) {
+	prototype := v.prototypes[name]
 	v.namedValues = make(map[string]interface{})
-	for _, param := range llvmFunc.Params() {
+	v.namedTypes = make(map[string]parser.Type)
+	v.currentCallees = nil
+	for i, param := range llvmFunc.Params() {
+		param.SetName(node.Prototype.Args[i])
 		v.namedValues[param.Name()] = param
+		v.namedTypes[param.Name()] = prototype.ArgType(i)
 	}
 	basicBlock := v.context.AddBasicBlock(llvmFunc, "entry")
 	v.builder.SetInsertPointAtEnd(basicBlock)
-	bodyValue := node.Body.Accept(v).(llvm.Value)
+	instrumented := v.instrumented()
+	if instrumented {
+		v.callRuntime(enterSymbol, v.builder.CreateGlobalStringPtr(name, "function"))
+	}
+	bodyValue := v.emitExpr(node.Body, prototype.ReturnType)
 	if bodyValue.IsNil() {
-		// Error reading body, remove function.
-		llvmFunc.EraseFromParentAsFunction()
 		panic("Error reading body")
 	}
+	if instrumented {
+		// The depth is left after the last call, even in tail position: a
+		// tail call is only a hint, so the recursion must still be counted.
+		v.callRuntime(leaveSymbol)
+	} else if call := bodyValue.IsACallInst(); !call.IsNil() {
+		// A recursion in tail position may then run in constant stack space.
+		call.SetTailCall(true)
+	}
 	v.builder.CreateRet(bodyValue)
 	if err := llvm.VerifyFunction(llvmFunc, llvm.PrintMessageAction); err != nil {
-		llvmFunc.EraseFromParentAsFunction()
 		panic(err)
 	}
-	v.lastPassManager.RunFunc(llvmFunc)
-	println(v.lastModule.String())
+	if v.passObserver != nil {
+		v.passObserver(name, runFunctionPassesByStage(llvmFunc, v.optimization))
+	} else {
+		v.lastPassManager.RunFunc(llvmFunc)
+	}
+}
+
+// defineWithStub compiles a function in its own module for the JIT, the
+// function being called through a stub so it can be redefined. compiled is
+// the module of the function when already compiled by a worker, or nil.
+func (v *VisitorKaleido) defineWithStub(node *parser.FunctionAST, name string, compiled *llvm.Module) llvm.Value {
+	arity := len(node.Prototype.Args)
+	previousProto := v.prototypes[name]
+	prototype := v.resolvePrototype(node, name)
+	stub, isNewStub := v.stubFor(name, prototype)
+	v.prototypes[name] = prototype
+	if isNewStub {
+		if v.stubs[name] == nil {
+			v.stubs[name] = make(map[int]*functionStub)
+		}
+		v.stubs[name][arity] = stub
+	}
+	v.versions[name]++
+	versionName := fmt.Sprintf("%s.%d", name, v.versions[name])
+	var llvmFunc llvm.Value
+	defined := false
+	defer func() {
+		if defined {
+			return
+		}
+		// Error while defining the function, restore the previous state.
+		if !llvmFunc.IsNil() {
+			llvmFunc.EraseFromParentAsFunction()
+		}
+		if isNewStub {
+			delete(v.stubs[name], arity)
+		}
+		v.restorePrototype(name, previousProto)
+	}()
+
+	// The callees are checked before any code is emitted, so a function
+	// which cannot be linked never reaches the compilation cache.
+	v.currentCallees = v.calleeSymbols(node.Body)
+	v.checkLinked(v.currentCallees)
+	cacheKey := ""
+	if compiled == nil {
+		cacheKey = v.cacheKey(node, name)
+	}
+	if cachedFunc, cached := v.loadFromCache(cacheKey, versionName); cached {
+		llvmFunc = cachedFunc
+		v.tracer.Infof(trace.Codegen, "Function %s loaded from the compilation cache", name)
+	} else if compiled != nil {
+		llvmFunc = v.linkCompiledFunction(*compiled, versionName)
+	} else {
+		llvmFunc = llvm.AddFunction(*v.lastModule, versionName, v.functionType(prototype))
+		llvmFunc.SetLinkage(llvm.ExternalLinkage)
+		v.emitFunctionBody(llvmFunc, node, name)
+		v.storeInCache(cacheKey)
+	}
+	if isNewStub {
+		v.defineStub(stub)
+	}
+	installFunc := v.installImplementation(stub, llvmFunc)
+	v.lastModulePassManager.Run(*v.lastModule)
+	defined = true
+	v.warnStaleCallers(name, previousProto, arity)
+	v.callees[name] = v.currentCallees
+	v.dependencies[name] = v.calleeNames(node.Body)
+	v.definitions[name] = llvmFunc
+	if name != parser.MainFunctionName {
+		v.accepted = append(v.accepted, node)
+	}
+	v.tracer.Infof(trace.Codegen, "Function %s compiled as %s", name, llvmFunc.Name())
+	v.tracer.Debugf(trace.Passes, "Module after passes:\n%s", v.lastModule.String())
+	module := *v.lastModule
 	v.switchModule()
+	v.jit.RunInitializer(installFunc)
+	v.replaceModule(name, module, arity, !isNewStub)
+	return llvmFunc
+}
+
+// defineInModule compiles a function into the single module of an ahead of
+// time compilation. A redefinition replaces the previous body for all the
+// callers, and each top level expression becomes an internal function.
+// compiled is the module of the function when already compiled by a worker,
+// or nil.
+func (v *VisitorKaleido) defineInModule(node *parser.FunctionAST, name string, compiled *llvm.Module) llvm.Value {
+	arity := len(node.Prototype.Args)
+	symbol, linkage := name, llvm.ExternalLinkage
+	if node.Private {
+		linkage = llvm.InternalLinkage
+	}
+	if name == parser.MainFunctionName {
+		symbol = fmt.Sprintf("%s.%d", name, len(v.topLevelFunctions)+1)
+		linkage = llvm.InternalLinkage
+	}
+	previousFunc := v.lastModule.NamedFunction(symbol)
+	if !previousFunc.IsNil() && previousFunc.ParamsCount() != arity {
+		panic(fmt.Sprintf("Function %s cannot change its number of arguments in a single module", name))
+	}
+	previousProto := v.prototypes[name]
+	prototype := v.resolvePrototype(node, name)
+	if !previousFunc.IsNil() && previousFunc.Type().ElementType() != v.functionType(prototype) {
+		typeError(node.Prototype.Pos, "Function %s cannot change its types in a single module", name)
+	}
+	v.prototypes[name] = prototype
+	var llvmFunc llvm.Value
+	defined := false
+	defer func() {
+		if !defined {
+			if !llvmFunc.IsNil() {
+				llvmFunc.EraseFromParentAsFunction()
+			}
+			v.restorePrototype(name, previousProto)
+		}
+	}()
+
+	if compiled != nil {
+		// The linker resolves a previous declaration with the definition.
+		llvmFunc = v.linkCompiledFunction(*compiled, symbol)
+		previousFunc = llvm.Value{}
+	} else {
+		// With a previous version, the new function gets a temporary name
+		// until it replaces the previous one.
+		llvmFunc = llvm.AddFunction(*v.lastModule, symbol, v.functionType(prototype))
+		v.emitFunctionBody(llvmFunc, node, name)
+	}
+	// The linkage is set once optimized, so the code does not depend on
+	// being compiled by a worker. Functions compiled by workers stay
+	// external until all of them are linked.
+	if compiled == nil {
+		llvmFunc.SetLinkage(linkage)
+	}
+	// The functions can be called from C once exported.
+	v.addExtensionAttributes(llvmFunc, prototype)
+	defined = true
+	if !previousFunc.IsNil() {
+		if !previousFunc.IsDeclaration() {
+			v.tracer.Infof(trace.Codegen, "Function %s redefined, previous definition replaced", name)
+		}
+		previousFunc.ReplaceAllUsesWith(llvmFunc)
+		previousFunc.EraseFromParentAsFunction()
+		llvmFunc.SetName(symbol)
+	}
+	if name == parser.MainFunctionName {
+		v.topLevelFunctions = append(v.topLevelFunctions, symbol)
+	} else {
+		if _, found := v.definitions[name]; found && len(v.topLevelFunctions) != 0 {
+			v.replaced = append(v.replaced, "Function "+name+" is redefined after a top level expression")
+		}
+		v.accepted = append(v.accepted, node)
+	}
+	v.definitions[name] = llvmFunc
+	v.tracer.Infof(trace.Codegen, "Function %s compiled as %s", name, llvmFunc.Name())
 	return llvmFunc
 }
+
+func (v *VisitorKaleido) restorePrototype(name string, previousProto *parser.PrototypeAST) {
+	if previousProto != nil {
+		v.prototypes[name] = previousProto
+	} else {
+		delete(v.prototypes, name)
+	}
+}
+
+// replaceModule removes from the JIT the module of the previous version of
+// a function, when replaced by the module of a new version. A module
+// defining the stub of the function is never removed.
+func (v *VisitorKaleido) replaceModule(name string, module llvm.Module, arity int, replaceable bool) {
+	if previous, found := v.replaceableModules[name]; found && previous.arity == arity {
+		v.jit.RemoveModule(previous.module)
+	}
+	delete(v.replaceableModules, name)
+	if replaceable {
+		v.replaceableModules[name] = replaceableModule{module: module, arity: arity}
+	}
+}
@@ -25,12 +25,20 @@ SOFTWARE.
 package visitor
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/llvm/llvm-project/llvm/bindings/go/llvm"
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
 	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser/yacc"
 )
 
@@ -85,3 +93,664 @@ func TestParseInvalidProgram(t *testing.T) {
 		}
 	}
 }
+
+func feed(t *testing.T, visitor *VisitorKaleido, input string) {
+	ast, err := yacc.BuildKaleidoAST(input)
+	if err != nil {
+		t.Fatal(input, err)
+	}
+	if err = visitor.FeedAST(ast); err != nil {
+		t.Fatal(input, err)
+	}
+}
+
+func feedAndEvaluate(t *testing.T, visitor *VisitorKaleido, input string) float64 {
+	feed(t, visitor, input)
+	result, err := visitor.EvalutateMain()
+	if err != nil {
+		t.Fatal(input, err)
+	}
+	return result
+}
+
+func TestFunctionRedefinition(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	feed(t, &visitor, "def f(x) x + 1")
+	feed(t, &visitor, "def g(x) f(x) * 2")
+	if result := feedAndEvaluate(t, &visitor, "g(1)"); result != 4 {
+		t.Errorf("Was waiting for 4 but received %v", result)
+	}
+	feed(t, &visitor, "def f(x) x + 10")
+	if result := feedAndEvaluate(t, &visitor, "g(1)"); result != 22 {
+		t.Errorf("Was waiting for 22 after redefinition but received %v", result)
+	}
+	if warnings := visitor.FlushWarnings(); len(warnings) != 0 {
+		t.Error("No warning expected, received", warnings)
+	}
+	feed(t, &visitor, "def f(x y) x + y")
+	if warnings := visitor.FlushWarnings(); len(warnings) != 1 {
+		t.Error("Was waiting for a warning about stale callers, received", warnings)
+	}
+	if result := feedAndEvaluate(t, &visitor, "g(1) + f(1, 2)"); result != 25 {
+		t.Errorf("Was waiting for 25 but received %v", result)
+	}
+}
+
+func TestAOTModule(t *testing.T) {
+	visitor, err := NewVisitorKaleidoAOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed(t, &visitor, "extern f(x); def g(x) f(x) * 2; def f(x) x + 1; def f(x) x + 10; g(1)")
+	module, err := visitor.Module()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"f", "g"} {
+		if function := module.NamedFunction(name); function.IsNil() || function.IsDeclaration() {
+			t.Error("Function", name, "should be defined in the module")
+		}
+	}
+	if _, err := visitor.EvalutateMain(); err == nil {
+		t.Error("An ahead of time compilation should not evaluate")
+	}
+	ast, _ := yacc.BuildKaleidoAST("def f(x y) x + y")
+	if err := visitor.FeedAST(ast); err == nil {
+		t.Error("Changing the arity in a single module should fail")
+	}
+}
+
+func TestDefineExecutableMain(t *testing.T) {
+	visitor, err := NewVisitorKaleidoAOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	feed(t, &visitor, "def f(x) x * 2; f(1); def g(x) f(x) + 1; g(2)")
+	if err := visitor.DefineExecutableMain(); err != nil {
+		t.Fatal(err)
+	}
+	module, err := visitor.Module()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainFunc := module.NamedFunction(ExecutableMainName)
+	if mainFunc.IsNil() || mainFunc.IsDeclaration() {
+		t.Fatal("The main function should be defined")
+	}
+	prints := 0
+	for block := mainFunc.FirstBasicBlock(); !block.IsNil(); block = llvm.NextBasicBlock(block) {
+		for instruction := block.FirstInstruction(); !instruction.IsNil(); instruction = llvm.NextInstruction(instruction) {
+			if !instruction.IsACallInst().IsNil() && instruction.CalledValue().Name() == printSymbol {
+				prints++
+			}
+		}
+	}
+	if prints != 2 {
+		t.Errorf("The result of the 2 top level expressions should be printed, %d are", prints)
+	}
+
+	jitVisitor := NewVisitorKaleido()
+	defer jitVisitor.Close()
+	if err := jitVisitor.DefineExecutableMain(); err == nil {
+		t.Error("The JIT should not generate an executable")
+	}
+	aotVisitor, err := NewVisitorKaleidoAOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aotVisitor.Close()
+	feed(t, &aotVisitor, "def main() 1")
+	if err := aotVisitor.DefineExecutableMain(); err == nil {
+		t.Error("A function named main should conflict with the generated one")
+	}
+	for _, input := range []string{"global g = 1; g; global g = 2; g", "def f() 1; f(); def f() 2; f()"} {
+		replacingVisitor, err := NewVisitorKaleidoAOT()
+		if err != nil {
+			t.Fatal(err)
+		}
+		feed(t, &replacingVisitor, input)
+		if err := replacingVisitor.DefineExecutableMain(); err == nil {
+			t.Errorf("The executable of %q would not evaluate its top level expressions in order", input)
+		}
+		replacingVisitor.Close()
+	}
+	redefiningVisitor, err := NewVisitorKaleidoAOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redefiningVisitor.Close()
+	feed(t, &redefiningVisitor, "def f() 1; def f() 2; f()")
+	if err := redefiningVisitor.DefineExecutableMain(); err != nil {
+		t.Errorf("A function redefined before the top level expressions should be accepted, received %v", err)
+	}
+}
+
+func TestExportedFunctions(t *testing.T) {
+	visitor, err := NewVisitorKaleidoAOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	feed(t, &visitor, "extern sin(x); def area(w h) w * h; def even(n: int) n * 0 < 1; private def helper(x) x; def pi() helper(3.14); area(1, 2)")
+	if _, err := visitor.Module(); err != nil {
+		t.Fatal(err)
+	}
+	functions, err := visitor.ExportedFunctions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	declarations := []string{}
+	for _, function := range functions {
+		declarations = append(declarations, CDeclaration(function))
+	}
+	expected := "double area(double, double); bool even(int64_t); double pi(void);"
+	if strings.Join(declarations, " ") != expected {
+		t.Errorf("Was waiting for %q but received %q", expected, strings.Join(declarations, " "))
+	}
+}
+
+func TestLinkBitcodeLibrary(t *testing.T) {
+	library, err := NewVisitorKaleidoAOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed(t, &library, "def square(x) x * x; def cube(x) x * square(x)")
+	module, err := library.Module()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path.Join(t.TempDir(), "lib.bc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := llvm.WriteBitcodeToFile(module, file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	visitor := NewVisitorKaleido()
+	if err := visitor.LinkBitcodeLibrary(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if result := feedAndEvaluate(t, &visitor, "cube(3) + square(2)"); result != 31 {
+		t.Errorf("Was waiting for 31 but received %v", result)
+	}
+}
+
+func TestPrivateFunctions(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	library, err := yacc.BuildKaleidoAST("private def helper(x) x * 2 def twice(x) helper(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range library.Funcs {
+		library.Funcs[i].Prototype.File = "/lib/math.kal"
+	}
+	if err := visitor.FeedAST(library); err != nil {
+		t.Fatal(err)
+	}
+	if result := feedAndEvaluate(t, &visitor, "twice(3)"); result != 6 {
+		t.Errorf("Was waiting for 6 but received %v", result)
+	}
+	ast, _ := yacc.BuildKaleidoAST("helper(3)")
+	if err := visitor.FeedAST(ast); err == nil {
+		t.Error("A private function should not be visible from another file")
+	}
+	if result := feedAndEvaluate(t, &visitor, "def helper(x) x + 100; twice(3) + helper(0)"); result != 106 {
+		t.Errorf("Was waiting for 106 but received %v", result)
+	}
+}
+
+func TestCompilationCache(t *testing.T) {
+	cache := NewCompilationCache(t.TempDir())
+	definitions := "def square(x) x * x; def f(x) square(x) + 1"
+	for run := 0; run < 2; run++ {
+		visitor := NewVisitorKaleido()
+		visitor.SetCache(cache)
+		feed(t, &visitor, definitions)
+		if result := feedAndEvaluate(t, &visitor, "f(3)"); result != 10 {
+			t.Errorf("Run %d: was waiting for 10 but received %v", run, result)
+		}
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 2 {
+		t.Errorf("Was waiting for 2 hits and 2 misses, received %d and %d", hits, misses)
+	}
+	// The prototype of square changes, f must be compiled again.
+	visitor := NewVisitorKaleido()
+	visitor.SetCache(cache)
+	feed(t, &visitor, "def square(x y) x * y; def f(x) square(x, 2) + 1")
+	if result := feedAndEvaluate(t, &visitor, "f(3)"); result != 7 {
+		t.Errorf("Was waiting for 7 but received %v", result)
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 4 {
+		t.Errorf("Was waiting for 2 hits and 4 misses, received %d and %d", hits, misses)
+	}
+	// A function calling a missing symbol is rejected before being cached.
+	dir := t.TempDir()
+	visitor = NewVisitorKaleido()
+	visitor.SetCache(NewCompilationCache(dir))
+	ast, err := yacc.BuildKaleidoAST("extern kaleidomissing(x); def g(x) kaleidomissing(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := visitor.FeedAST(ast); err == nil {
+		t.Error("A missing symbol should be reported")
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Nothing should be cached, found %d entries", len(entries))
+	}
+}
+
+func generatedProgram(functions int) string {
+	var builder strings.Builder
+	builder.WriteString("extern sin(x);\n")
+	for i := 0; i < functions; i++ {
+		switch {
+		case i == 0:
+			builder.WriteString("def f0(x) sin(x) * 2 + 1;\n")
+		case i%3 == 0:
+			fmt.Fprintf(&builder, "private def f%d(x) f%d(x) * f%d(x - 1) + %d;\n", i, i-1, i/2, i)
+		default:
+			fmt.Fprintf(&builder, "def f%d(x) f%d(x + 1) - f%d(x) * 0.5;\n", i, i-1, i/3)
+		}
+	}
+	return builder.String()
+}
+
+func TestParallelCompilationIsDeterministic(t *testing.T) {
+	source := generatedProgram(40)
+	var reference string
+	for _, workers := range []int{1, 2, 8} {
+		visitor, err := NewVisitorKaleidoAOT()
+		if err != nil {
+			t.Fatal(err)
+		}
+		visitor.SetWorkers(workers)
+		feed(t, &visitor, source)
+		module, err := visitor.Module()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if workers == 1 {
+			reference = module.String()
+		} else if module.String() != reference {
+			t.Errorf("Module compiled with %d workers differs from the sequential one", workers)
+		}
+	}
+}
+
+func TestParallelCompilationInJIT(t *testing.T) {
+	source := generatedProgram(20) + "def f5(x) x; f19(0.5) + f5(2)"
+	sequential := NewVisitorKaleido()
+	expected := feedAndEvaluate(t, &sequential, source)
+	parallel := NewVisitorKaleido()
+	parallel.SetWorkers(4)
+	if result := feedAndEvaluate(t, &parallel, source); result != expected {
+		t.Errorf("Was waiting for %v but received %v", expected, result)
+	}
+	ast, _ := yacc.BuildKaleidoAST("def ok(x) x; def broken(x) unknown(x); def later(x) x")
+	if err := parallel.FeedAST(ast); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Error("Was waiting for an error about unknown, received", err)
+	}
+	names := []string{}
+	for _, function := range parallel.Functions() {
+		names = append(names, function.Name)
+	}
+	if joined := strings.Join(names, " "); !strings.Contains(joined, "ok") || strings.Contains(joined, "later") {
+		t.Error("Functions before the error should be defined, not the ones after:", joined)
+	}
+}
+
+func TestInterruptibleFunctions(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	visitor.SetInterruptible(true)
+	// Ten levels of functions calling the previous one eight times: too many
+	// calls to end before the deadline, with a depth of ten.
+	feed(t, &visitor, "def loop0(x) x + 1")
+	for level := 1; level < 10; level++ {
+		feed(t, &visitor, fmt.Sprintf("def loop%d(x) %s0", level, strings.Repeat(fmt.Sprintf("loop%d(x) + ", level-1), 8)))
+	}
+	feed(t, &visitor, "def loop(x) loop9(x); def double(x) x * 2")
+	ir, err := visitor.FunctionIR("loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ir, "call void @kaleido.enter(") || !strings.Contains(ir, "call void @kaleido.leave()\n  ret double %calltmp") {
+		t.Errorf("Missing instrumentation after the last call in:\n%s", ir)
+	}
+	loop, err := visitor.CompiledFunction("loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := loop.CallContext(ctx, 0); err != context.DeadlineExceeded {
+		t.Errorf("Was waiting for the deadline but received %v", err)
+	}
+	double, err := visitor.CompiledFunction("double")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := double.CallContext(context.Background(), 4); err != nil || result != 8 {
+		t.Errorf("Was waiting for 8 but received %v, %v", result, err)
+	}
+}
+
+func TestRecursionLimit(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	visitor.SetRecursionLimit(100)
+	feed(t, &visitor, "def deep(x) deep(x) + 1; def one(x) 1")
+	// More sequential calls than the limit, the depth staying at 2.
+	feed(t, &visitor, "def many(x) "+strings.Repeat("one(x) + ", 150)+"0")
+	deep, err := visitor.CompiledFunction("deep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = deep.Call(0)
+	var limitErr *RecursionLimitError
+	if !errors.As(err, &limitErr) || limitErr.Function != "deep" || limitErr.Limit != 100 {
+		t.Errorf("Was waiting for the recursion limit in deep, received %v", err)
+	}
+	if result := feedAndEvaluate(t, &visitor, "many(0)"); result != 150 {
+		t.Errorf("Was waiting for 150 but received %v", result)
+	}
+}
+
+func TestRecursionLimitTailCall(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	visitor.SetOptimization(OptimizationConfig{Level: 0})
+	visitor.SetRecursionLimit(1000)
+	feed(t, &visitor, "def f(x) f(x)")
+	ast, _ := yacc.BuildKaleidoAST("f(1)")
+	if err := visitor.FeedAST(ast); err != nil {
+		t.Fatal(err)
+	}
+	_, err := visitor.EvalutateMain()
+	var limitErr *RecursionLimitError
+	if !errors.As(err, &limitErr) || limitErr.Function != "f" {
+		t.Errorf("Was waiting for the recursion limit in f, received %v", err)
+	}
+}
+
+func TestExternPolicy(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	visitor.SetExternPolicy(AllowExterns(MathExterns...))
+	if result := feedAndEvaluate(t, &visitor, "extern cos(x); cos(0)"); result != 1 {
+		t.Errorf("Was waiting for 1 but received %v", result)
+	}
+	ast, _ := yacc.BuildKaleidoAST("extern system(x); extern exit(x); extern sin(x); def f(x) sin(x)")
+	err := visitor.FeedAST(ast)
+	if err == nil || err.Error() != "External functions not allowed: system, exit" {
+		t.Errorf("Was waiting for an error naming system and exit, received %v", err)
+	}
+	for _, function := range visitor.Functions() {
+		if function.Name != "cos" && function.Name != parser.MainFunctionName {
+			t.Errorf("Function %s of a rejected program should not be declared", function.Name)
+		}
+	}
+	feed(t, &visitor, "extern twice(x); def twice(x) x * 2; extern twice(x);")
+	accepted := len(visitor.AcceptedDefinitions())
+	for _, input := range []string{"extern getpid(); def getpid() nope", "getpid()", "extern getpid();"} {
+		ast, err := yacc.BuildKaleidoAST(input)
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		if err := visitor.FeedAST(ast); err == nil {
+			t.Errorf("Was waiting for an error with %q", input)
+		}
+	}
+	if len(visitor.AcceptedDefinitions()) != accepted {
+		t.Errorf("The extern of a rejected program should not be accepted")
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	prices := map[float64]float64{1: 9.5, 2: 12}
+	if err := visitor.RegisterFunc("price", func(item float64) float64 { return prices[item] }); err != nil {
+		t.Fatal(err)
+	}
+	if err := visitor.RegisterFunc("clamp", func(x, low, high float64) float64 { return math.Max(low, math.Min(x, high)) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := visitor.RegisterFunc("sum4", func(a, b, c, d float64) float64 { return a + b + c + d }); err != nil {
+		t.Fatal(err)
+	}
+	if err := visitor.RegisterFunc("fail", func() float64 { panic("out of stock") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := visitor.RegisterFunc("bad", func(x int) float64 { return 0 }); err == nil {
+		t.Error("Was waiting for an error with an int argument")
+	}
+	feed(t, &visitor, "extern price(item); def total(a b) price(a) + price(b)")
+	if result := feedAndEvaluate(t, &visitor, "clamp(total(1, 2), 0, 20) + sum4(1, 2, 3, 4)"); result != 30 {
+		t.Errorf("Was waiting for 30 but received %v", result)
+	}
+	prices[2] = 2
+	if result := feedAndEvaluate(t, &visitor, "total(1, 2)"); result != 11.5 {
+		t.Errorf("Was waiting for 11.5 but received %v", result)
+	}
+	ast, _ := yacc.BuildKaleidoAST("fail() + 1")
+	if err := visitor.FeedAST(ast); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := visitor.EvalutateMain(); err == nil || !strings.Contains(err.Error(), "out of stock") {
+		t.Errorf("Was waiting for the panic of the Go function, received %v", err)
+	}
+	for _, source := range []string{"extern price(a b);", "def price(x) x"} {
+		ast, _ := yacc.BuildKaleidoAST(source)
+		if err := visitor.FeedAST(ast); err == nil {
+			t.Errorf("%q should be rejected", source)
+		}
+	}
+}
+
+func TestOutput(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	var output strings.Builder
+	visitor.SetOutput(&output)
+	feedAndEvaluate(t, &visitor, "extern putchard(c); extern printd(x); putchard(65) + putchard(10) + printd(1.5)")
+	if output.String() != "A\n1.500000\n" {
+		t.Errorf("Unexpected output %q", output.String())
+	}
+}
+
+func TestGlobalsAndConstants(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	visitor.SetWorkers(4)
+	feed(t, &visitor, "const pi = 3; const tau = pi * 2; global r = 2 def area() pi * r * r def perimeter() tau * r def scaled(r) r * tau")
+	if result := feedAndEvaluate(t, &visitor, "area() + perimeter() + scaled(10)"); result != 12+12+60 {
+		t.Errorf("Was waiting for 84 but received %v", result)
+	}
+	if result := feedAndEvaluate(t, &visitor, "global r = 1; area()"); result != 3 {
+		t.Errorf("The new value of the global should be seen, received %v", result)
+	}
+	r, err := visitor.Global("r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Get() != 1 {
+		t.Errorf("Was waiting for 1 but received %v", r.Get())
+	}
+	if err := r.Set(10); err != nil {
+		t.Fatal(err)
+	}
+	if result := feedAndEvaluate(t, &visitor, "perimeter()"); result != 60 {
+		t.Errorf("Was waiting for 60 but received %v", result)
+	}
+	if module, _ := visitor.definitionModule("area"); strings.Contains(module.String(), "pi") {
+		t.Error("Constants should be folded:\n", module.String())
+	}
+	pi, err := visitor.Global("pi")
+	if err != nil || pi.Get() != 3 || pi.Set(4) == nil {
+		t.Error("A constant should be readable but not writable:", err)
+	}
+	invalidInputs := []string{"const pi = 4", "global pi = 3", "const r = 1", "global x = r", "global x = f(1)", "def f() unknown"}
+	for _, input := range invalidInputs {
+		ast, err := yacc.BuildKaleidoAST(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := visitor.FeedAST(ast); err == nil {
+			t.Error("Was waiting for an error for", input)
+		}
+	}
+	feed(t, &visitor, "const pi = 3")
+	if _, err := visitor.Global("x"); err == nil {
+		t.Error("Was waiting for an error for an unknown global")
+	}
+}
+
+func TestStaticTypes(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	visitor.SetWorkers(4)
+	feed(t, &visitor, `def half(n: int) n * 0.5
+def twice(n: int) n * 2 + 1
+def less(a b) a < b
+def count(a b) less(a, b) + less(b, a) + 1
+def truncate(x) int(x) * 1000000007 * 1000000007`)
+	expectations := map[string]parser.Type{"half": parser.TypeDouble, "twice": parser.TypeInt, "less": parser.TypeBool, "count": parser.TypeInt, "truncate": parser.TypeInt}
+	for _, function := range visitor.Functions() {
+		if expected, found := expectations[function.Name]; found && function.ReturnType != expected {
+			t.Errorf("%s should return %s, not %s", function.Name, expected, function.ReturnType)
+		}
+	}
+	if result := feedAndEvaluate(t, &visitor, "twice(20) + half(3) + count(1, 2)"); result != 41+1.5+2 {
+		t.Errorf("Was waiting for 44.5 but received %v", result)
+	}
+	if result := feedAndEvaluate(t, &visitor, "truncate(3.9)"); result != 3*1000000007*1000000007 {
+		t.Errorf("Integer arithmetic should be exact, received %v", result)
+	}
+	twice, err := visitor.CompiledFunction("twice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := twice.Call(2.9); err != nil || result != 5 {
+		t.Errorf("The argument should be truncated, received %v, %v", result, err)
+	}
+	invalidInputs := map[string]string{
+		"twice(1.5)":                              "1:1: Cannot use double as int in argument 1 of twice",
+		"def f(x): int x":                         "1:5: Function f returns double, not int",
+		"def f(x: float) x":                       "1:5: Unknown type float",
+		"def twice(n) n":                          "1:5: Function twice cannot change its types from (int): int to (double): double",
+		"def r(n: int) r(n - 1) < 2":              "1:5: The result of the recursive function r is bool, it must be annotated",
+		"def f(b: bool) b\n\nf(1 + 2)":            "3:1: Cannot use untyped int as bool in argument 1 of f",
+		"def big(n: int) n + 9223372036854775808": "1:21: Integer 9223372036854775808 does not fit in an int",
+	}
+	for input, expected := range invalidInputs {
+		ast, err := yacc.BuildKaleidoAST(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := visitor.FeedAST(ast); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("Was waiting for the error %q for %q, received %v", expected, input, err)
+		}
+	}
+	feed(t, &visitor, "def toint(x) int(x)")
+	toint, err := visitor.CompiledFunction("toint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saturated := map[float64]float64{math.Inf(1): math.MaxInt64, math.Inf(-1): math.MinInt64, 1e300: math.MaxInt64, math.NaN(): 0}
+	for input, expected := range saturated {
+		if result, err := toint.Call(input); err != nil || result != expected {
+			t.Errorf("int(%v) should saturate to %v, received %v, %v", input, expected, result, err)
+		}
+	}
+	feed(t, &visitor, "def r(n: int): bool r(n - 1) < 2; def double(x) x * 2")
+	if result := feedAndEvaluate(t, &visitor, "double(2.5) + bool(0.5) + int(1.5)"); result != 7 {
+		t.Errorf("A function named double should hide the conversion, received %v", result)
+	}
+}
+
+func TestFlushAfterCExterns(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	feed(t, &visitor, "extern cos(x); extern printd(x); cos(0)")
+	if visitor.callSettings.flushStdout != 0 {
+		t.Error("The runtime library does not need stdout to be flushed")
+	}
+	feed(t, &visitor, "extern puts(s: ptr): int;")
+	if visitor.callSettings.flushStdout == 0 {
+		t.Error("A C function may write to stdout, which must be flushed")
+	}
+}
+
+func TestCExterns(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	visitor.SetWorkers(4)
+	feed(t, &visitor, `extern strlen(s: i8*): i64; extern abs(x: i32): i32; extern sqrtf(x: f32): f32;
+extern malloc(size: i64): ptr; extern free(p: void*): void; extern atoi(s: i8*): i32;
+extern snprintf(buffer: i8*, size: i64, format: i8*, ...): i32;
+def format(buffer: ptr) snprintf(buffer, 32, "%d %ld %.1f %s", 12, int(345), 2.5, "a\tb") * 100 + atoi(buffer)
+def run(buffer: ptr) format(buffer) + free(buffer)`)
+	if result := feedAndEvaluate(t, &visitor, `strlen("a\"b\n") + abs(0 - 7) + sqrtf(2.25)`); result != 4+7+1.5 {
+		t.Errorf("Was waiting for 12.5 but received %v", result)
+	}
+	if result := feedAndEvaluate(t, &visitor, "run(malloc(32))"); result != 1400+12 {
+		t.Errorf("Was waiting for 1412 but received %v", result)
+	}
+	if _, err := visitor.CompiledFunction("strlen"); err == nil {
+		t.Error("A function taking a pointer should not be callable from Go")
+	}
+	invalidInputs := map[string]string{
+		"def f(x: i32) x":        "1:5: Type i32 can only be used by an extern",
+		"def f(x ...) x":         "1:5: Function f cannot be variadic",
+		"extern g(x: void);":     "1:8: Argument x of g cannot be void",
+		"strlen(3)":              "1:1: Cannot use untyped int as ptr in argument 1 of strlen",
+		`def f() "a" * 2`:        "1:13: Operator * cannot be used on ptr",
+		"snprintf(malloc(1), 1)": "1:1: Function snprintf: incorrect number of arguments",
+	}
+	for input, expected := range invalidInputs {
+		ast, err := yacc.BuildKaleidoAST(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := visitor.FeedAST(ast); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("Was waiting for the error %q for %q, received %v", expected, input, err)
+		}
+	}
+}
+
+func TestSharedLibraries(t *testing.T) {
+	visitor := NewVisitorKaleido()
+	defer visitor.Close()
+	feed(t, &visitor, `extern "libm.so.6" cbrt(x);`)
+	if result := feedAndEvaluate(t, &visitor, "cbrt(8)"); result != 2 {
+		t.Errorf("Was waiting for 2 but received %v", result)
+	}
+	if libraries := visitor.Libraries(); len(libraries) != 1 || libraries[0] != "libm.so.6" {
+		t.Error("Unexpected libraries:", libraries)
+	}
+	if err := visitor.LoadLibrary("libkaleidomissing.so"); err == nil {
+		t.Error("A missing library should not be loaded")
+	}
+	ast, err := yacc.BuildKaleidoAST("extern kaleidomissing(x); def f(x) kaleidomissing(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := visitor.FeedAST(ast); err == nil || !strings.HasPrefix(err.Error(), "Function kaleidomissing not found") {
+		t.Errorf("A missing symbol should be reported, received %v", err)
+	}
+	if _, err := visitor.CompiledFunction("kaleidomissing"); err == nil {
+		t.Error("A missing symbol should not be callable")
+	}
+	visitor.SetExternPolicy(AllowExterns("cbrt", "floor"))
+	ast, err = yacc.BuildKaleidoAST(`extern "libm.so.6" cbrt(x); extern "libother.so" floor(x);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := visitor.FeedAST(ast); err == nil || err.Error() != "Library libother.so not allowed, it must be loaded beforehand" {
+		t.Errorf("Only the loaded libraries should be allowed, received %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+)
+
+const printerIndentation = "  "
+
+// VisitorPrinter renders an AST as an indented tree, one node per line.
+type VisitorPrinter struct{}
+
+// DumpAST returns a textual tree of a whole program.
+func DumpAST(program *parser.ProgramAST) string {
+	printer := VisitorPrinter{}
+	var builder strings.Builder
+	for _, importAST := range program.Imports {
+		builder.WriteString(fmt.Sprintf("Import %q\n", importAST.Path))
+	}
+	for i := range program.Globals {
+		builder.WriteString(program.Globals[i].Accept(&printer).(string))
+	}
+	for i := range program.Protos {
+		builder.WriteString("Extern " + program.Protos[i].Accept(&printer).(string))
+	}
+	for i := range program.Funcs {
+		builder.WriteString(program.Funcs[i].Accept(&printer).(string))
+	}
+	return builder.String()
+}
+
+func indent(lines string) string {
+	var builder strings.Builder
+	for _, line := range strings.SplitAfter(lines, "\n") {
+		if line != "" {
+			builder.WriteString(printerIndentation + line)
+		}
+	}
+	return builder.String()
+}
+
+func (p *VisitorPrinter) VisitNumberExprAST(node *parser.NumberExprAST) interface{} {
+	return fmt.Sprintf("Number %s\n", node.Value)
+}
+
+func (p *VisitorPrinter) VisitStringExprAST(node *parser.StringExprAST) interface{} {
+	return fmt.Sprintf("String %q\n", string(*node))
+}
+
+func (p *VisitorPrinter) VisitBinaryExprAST(node *parser.BinaryExprAST) interface{} {
+	return fmt.Sprintf("Binary %c\n", node.Op) +
+		indent(node.LHS.Accept(p).(string)) +
+		indent(node.RHS.Accept(p).(string))
+}
+
+func (p *VisitorPrinter) VisitVariableExprAST(node *parser.VariableExprAST) interface{} {
+	return fmt.Sprintf("Variable %s\n", string(*node))
+}
+
+func (p *VisitorPrinter) VisitCallExprAST(node *parser.CallExprAST) interface{} {
+	result := fmt.Sprintf("Call %s\n", node.FunctionName)
+	for _, arg := range node.Args {
+		result += indent(arg.Accept(p).(string))
+	}
+	return result
+}
+
+func (p *VisitorPrinter) VisitPrototypeAST(node *parser.PrototypeAST) interface{} {
+	if node.Library != "" {
+		return fmt.Sprintf("%s from %q\n", formatPrototype(node), node.Library)
+	}
+	return formatPrototype(node) + "\n"
+}
+
+func (p *VisitorPrinter) VisitFunctionAST(node *parser.FunctionAST) interface{} {
+	kind := "Function "
+	if node.Private {
+		kind = "Private function "
+	}
+	return kind + node.Prototype.Accept(p).(string) + indent(node.Body.Accept(p).(string))
+}
+
+func (p *VisitorPrinter) VisitGlobalAST(node *parser.GlobalAST) interface{} {
+	kind := "Global "
+	if node.Const {
+		kind = "Const "
+	}
+	return kind + node.Name + "\n" + indent(node.Value.Accept(p).(string))
+}
@@ -0,0 +1,52 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"testing"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser/yacc"
+)
+
+func TestDumpAST(t *testing.T) {
+	ast, err := yacc.BuildKaleidoAST("const k = 2; extern sin(x); def f(a b) a + sin(b) * 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `Const k
+  Number 2
+Extern sin(x)
+Function f(a b)
+  Binary +
+    Variable a
+    Binary *
+      Call sin
+        Variable b
+      Number 2
+`
+	if dump := DumpAST(ast); dump != expected {
+		t.Errorf("Was waiting for:\n%s\nbut received:\n%s", expected, dump)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser"
+)
+
+// VisitorSource renders an AST back to Kaleidoscope source code. Binary
+// expressions are fully parenthesized so the result parses to the same AST.
+type VisitorSource struct{}
+
+// FormatDefinition returns the source of a top level definition: an extern
+// prototype, a function, a global or a constant.
+func FormatDefinition(node parser.Visitable) string {
+	source := node.Accept(&VisitorSource{}).(string)
+	if prototype, isPrototype := node.(*parser.PrototypeAST); isPrototype {
+		if prototype.Library != "" {
+			return "extern " + quoteString(prototype.Library) + " " + source + ";"
+		}
+		return "extern " + source + ";"
+	}
+	return source + ";"
+}
+
+func (s *VisitorSource) VisitNumberExprAST(node *parser.NumberExprAST) interface{} {
+	return node.Value
+}
+
+// sourceEscaper writes the characters of a string literal needing an escape
+// sequence.
+var sourceEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+
+// quoteString returns the source of a string literal.
+func quoteString(value string) string {
+	return `"` + sourceEscaper.Replace(value) + `"`
+}
+
+func (s *VisitorSource) VisitStringExprAST(node *parser.StringExprAST) interface{} {
+	return quoteString(string(*node))
+}
+
+func (s *VisitorSource) VisitBinaryExprAST(node *parser.BinaryExprAST) interface{} {
+	return fmt.Sprintf("(%s %c %s)", node.LHS.Accept(s), node.Op, node.RHS.Accept(s))
+}
+
+func (s *VisitorSource) VisitVariableExprAST(node *parser.VariableExprAST) interface{} {
+	return string(*node)
+}
+
+func (s *VisitorSource) VisitCallExprAST(node *parser.CallExprAST) interface{} {
+	args := make([]string, 0, len(node.Args))
+	for _, arg := range node.Args {
+		args = append(args, arg.Accept(s).(string))
+	}
+	return fmt.Sprintf("%s(%s)", node.FunctionName, strings.Join(args, ", "))
+}
+
+func (s *VisitorSource) VisitPrototypeAST(node *parser.PrototypeAST) interface{} {
+	return formatPrototype(node)
+}
+
+// formatPrototype returns the source of a prototype, with its annotations.
+func formatPrototype(node *parser.PrototypeAST) string {
+	args := make([]string, 0, len(node.Args))
+	for i, arg := range node.Args {
+		if i < len(node.ArgTypes) && node.ArgTypes[i] != parser.TypeUnspecified {
+			arg += ": " + string(node.ArgTypes[i])
+		}
+		args = append(args, arg)
+	}
+	if node.Variadic {
+		args = append(args, "...")
+	}
+	source := fmt.Sprintf("%s(%s)", node.FunctionName, strings.Join(args, " "))
+	if node.ReturnType != parser.TypeUnspecified {
+		source += ": " + string(node.ReturnType)
+	}
+	return source
+}
+
+func (s *VisitorSource) VisitFunctionAST(node *parser.FunctionAST) interface{} {
+	if node.Private {
+		return fmt.Sprintf("private def %s %s", node.Prototype.Accept(s), node.Body.Accept(s))
+	}
+	return fmt.Sprintf("def %s %s", node.Prototype.Accept(s), node.Body.Accept(s))
+}
+
+func (s *VisitorSource) VisitGlobalAST(node *parser.GlobalAST) interface{} {
+	if node.Const {
+		return fmt.Sprintf("const %s = %s", node.Name, node.Value.Accept(s))
+	}
+	return fmt.Sprintf("global %s = %s", node.Name, node.Value.Accept(s))
+}
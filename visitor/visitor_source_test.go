@@ -0,0 +1,56 @@
+/*
+MIT License
+
+Copyright (c) 2021 Vincent Hiribarren
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package visitor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vhiribarren/tuto-llvm-kaleidoscope-golang/parser/yacc"
+)
+
+func TestFormatDefinitionRoundTrip(t *testing.T) {
+	input := "const k = 2 global g = k * 3; extern sin(x); def f(a b) a + sin(b) * (2 - a) < 3 private def g() f(1, 2) def t(n: int, x): bool int(x) < n extern \"libm.so.6\" cbrt(x); extern printf(f: i8*, ...): i32; def p() printf(\"\\\"%s\\\"\\n\", \"a\\tb\")"
+	ast, err := yacc.BuildKaleidoAST(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	visitor := NewVisitorKaleido()
+	if err := visitor.FeedAST(ast); err != nil {
+		t.Fatal(err)
+	}
+	var sources []string
+	for _, definition := range visitor.AcceptedDefinitions() {
+		sources = append(sources, FormatDefinition(definition))
+	}
+	formatted := strings.Join(sources, "\n")
+	reparsedAST, err := yacc.BuildKaleidoAST(formatted)
+	if err != nil {
+		t.Fatal(formatted, err)
+	}
+	if DumpAST(reparsedAST) != DumpAST(ast) {
+		t.Errorf("Formatted source does not give the same AST:\n%s", formatted)
+	}
+}